@@ -3,39 +3,38 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	zmq "github.com/pebbe/zmq4"
+	"io"
 	"log"
-	// "os"
-	// "os/exec"
+	"os"
+	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
-const (
-	MsgAgentStartApp = iota
-	MsgAgentStopApp
-	MsgAgentPs
-	MsgAgentPing
-	MsgAgentPingReply
-	MsgAgentKillPid
-	MsgAgentForceKillPid
-	MsgAgentError
-)
-
-//AgentMsg is a struct that represents requests and replies to an agent from the CLI.
-//The MsgData field is an operation specific JSON encoded structure.
-type AgentMsg struct {
-	MsgType int
-	AppID   string
-	MsgData string
-	Error   string
+//agentOps maps the agent requests that need authorization to the operation checked by Authorize.
+var agentOps = map[int]string{
+	MsgAgentStartApp:     OpStart,
+	MsgAgentStopApp:      OpStop,
+	MsgAgentPs:           OpPs,
+	MsgAgentKillPid:      OpKill,
+	MsgAgentForceKillPid: OpKill,
+	MsgAgentRestartApp:   OpRestart,
+	MsgAgentStatusApp:    OpStatus,
+	MsgAgentLogs:         OpLogs,
 }
 
+//AgentService registers the agent with the scheduler and serves agent requests on
+//WT_AGENTLISTEN. It is intended to be run inside a go routine, it returns once services are
+//stopping and the running requests are answered.
 func AgentService() {
 	if config.Debug {
 		log.Println("AgentService()")
@@ -54,263 +53,479 @@ func AgentService() {
 		log.Fatalln("agent must be run as root")
 	}
 
-	responder, err := zmq.NewSocket(zmq.REP)
-	if err != nil {
-		log.Fatalln("AgentService() 0MQ NewSocket:", err)
-	}
+	go AgentRegistration()
+	pool := newAgentPool(config.AgentWorkers)
+	pool.Serve(config.AgentListen)
+	log.Println("AgentService(): shutting down")
+}
+
+//AgentHandle authorizes and performs a single agent request and returns the reply. It runs
+//on an agentPool worker, so requests for different AppIDs may be handled concurrently. If sink
+//is not nil command output is also passed to it while the command runs, and is left out of the
+//reply. Cancelling ctx kills any command the request is running.
+func AgentHandle(ctx context.Context, Query *AgentMsg, sink OutputSink) AgentMsg {
+	var Reply = AgentMsg{Proto: ProtocolVersion}
 
-	defer responder.Close()
-	if err := responder.Bind(config.AgentListen); err != nil {
-		log.Fatalln("SchedulerService():responder.Bind(", config.AgentListen, ")", err.Error())
+	if _, ok := agentOps[Query.MsgType]; !ok && Query.MsgType != MsgAgentPing {
+		return AgentMsg{MsgType: MsgAgentUnsupported, AppID: Query.AppID, Proto: ProtocolVersion,
+			Error: fmt.Sprintf("unsupported request type %d", Query.MsgType)}
 	}
-	for {
-		msg, err := responder.RecvBytes(0) //Flags for Recv?
-		if config.Debug {
-			log.Println("AgentService() 0MQ Recv:", bytes.NewBuffer(msg).String())
+	if Query.MsgType != MsgAgentPing {
+		if err := Authorize(Query.User, Query.Password, agentOps[Query.MsgType], Query.AppID); err != nil {
+			return AgentMsg{MsgType: MsgAgentDenied, AppID: Query.AppID, Proto: ProtocolVersion, Error: err.Error()}
 		}
+	}
 
-		if config.Debug && err != nil {
-			log.Println("AgentService() 0MQ Recv error: ", err.Error())
-		}
+	// var cmdOutput string
+	var runErr error
+	Reply.MsgType = Query.MsgType
 
-		if err != nil {
-			continue
-		}
-		var Query AgentMsg
-		var Reply AgentMsg
-
-		if err := json.Unmarshal(msg, &Query); err != nil {
-			Reply = AgentMsg{MsgAgentError, "", "", err.Error()}
-			b, _ := json.Marshal(Reply)
-			responder.SendBytes(b, 0)
-			if config.Debug {
-				log.Println("AgentService() json Unmarshal: ", err)
-			}
-			continue
-		}
+	switch {
+	case Query.MsgType == MsgAgentStartApp:
+		Reply.MsgData, runErr = AgentStartApp(ctx, Query.AppID, sink)
 
-		// var cmdOutput string
-		var runErr error
-		Reply.MsgType = Query.MsgType
+	case Query.MsgType == MsgAgentStopApp:
+		Reply.MsgData, runErr = AgentStopApp(ctx, Query.AppID, sink)
 
-		switch {
-		case Query.MsgType == MsgAgentStartApp:
-			Reply.MsgData, runErr = AgentStartApp(Query.AppID)
+	case Query.MsgType == MsgAgentRestartApp:
+		Reply.MsgData, runErr = AgentRestartApp(ctx, Query.AppID, sink)
 
-		case Query.MsgType == MsgAgentStopApp:
-			Reply.MsgData, runErr = AgentStopApp(Query.AppID)
+	case Query.MsgType == MsgAgentStatusApp:
+		Reply.MsgData, runErr = AgentStatusApp(ctx, Query.AppID)
 
-		case Query.MsgType == MsgAgentPs:
-			Reply.MsgData, runErr = AgentPs(Query.AppID)
-		case Query.MsgType == MsgAgentKillPid:
-			Reply.MsgData, runErr = AgentKillPid(Query.AppID, Query.MsgData)
+	case Query.MsgType == MsgAgentLogs:
+		Reply.MsgData, runErr = AgentLogs(ctx, Query.AppID, Query.MsgData, sink)
 
-		case Query.MsgType == MsgAgentPing:
-			Reply.MsgType = MsgAgentPingReply
+	case Query.MsgType == MsgAgentPs:
+		Reply.MsgData, runErr = AgentPs(Query.AppID)
+	case Query.MsgType == MsgAgentKillPid:
+		Reply.MsgData, runErr = AgentKillPid(Query.AppID, Query.MsgData, "TERM")
 
-		case Query.MsgType == MsgAgentPingReply:
-			runErr = errors.New("malformed agent request")
-		}
+	case Query.MsgType == MsgAgentForceKillPid:
+		Reply.MsgData, runErr = AgentKillPid(Query.AppID, Query.MsgData, "KILL")
 
-		if runErr != nil {
-			Reply.Error = runErr.Error()
-			Reply.MsgType = MsgAgentError
-		}
-		b, _ := json.Marshal(Reply)
-		responder.SendBytes(b, 0)
+	case Query.MsgType == MsgAgentPing:
+		Reply.MsgType = MsgAgentPingReply
+		Reply.Caps = agentCaps
+	}
 
-	} //end for{}
+	if sink != nil {
+		switch Query.MsgType {
+		case MsgAgentStartApp, MsgAgentStopApp, MsgAgentRestartApp, MsgAgentLogs:
+			Reply.MsgData = "" //Already streamed.
+		}
+	}
 
+	if runErr != nil {
+		Reply.Error = runErr.Error()
+		Reply.MsgType = MsgAgentError
+		if runErr == ErrExecTimeout {
+			Reply.MsgType = MsgAgentExecTimeout
+		}
+		var exitErr *exec.ExitError
+		if errors.As(runErr, &exitErr) {
+			Reply.ExitCode = exitErr.ExitCode()
+		}
+	}
+	return Reply
 }
 
-func AgentReqStartApp(appid string) (string, error) {
-	var req = AgentMsg{MsgAgentStartApp, appid, "", ""}
-	agentConnect, err := SchedulerReqLookup(appid)
+func AgentStartApp(ctx context.Context, appid string, sink OutputSink) (string, error) {
+	u, err := user.Lookup(appid)
 	if err != nil {
 		return "", err
 	}
 
-	reply, reqError := AgentReq(&req, agentConnect)
-	if reqError != nil {
-		return "", errors.New(reply.Error)
-	}
+	start := time.Now()
+	output, err := runCommand(ctx, u, []string{"bin/start"}, u.HomeDir, execTimeout(OpStart), sink)
+	Metrics.Command(OpStart, time.Since(start))
+	return output, err
+}
 
-	if reply.MsgType != MsgAgentStartApp {
-		return reply.MsgData, errors.New(reply.Error)
+func AgentStopApp(ctx context.Context, appid string, sink OutputSink) (string, error) {
+	u, err := user.Lookup(appid)
+	if err != nil {
+		return "", err
 	}
 
-	return reply.MsgData, nil
+	start := time.Now()
+	output, err := runCommand(ctx, u, []string{"bin/stop"}, u.HomeDir, execTimeout(OpStop), sink)
+	Metrics.Command(OpStop, time.Since(start))
+	return output, err
 }
 
-func AgentReqPs(appid string) (string, error) {
-	var req = AgentMsg{MsgAgentPs, appid, "", ""}
-	agentConnect, err := SchedulerReqLookup(appid)
+//AgentRestartApp runs ~/bin/restart if the app has one, otherwise ~/bin/stop followed by
+//~/bin/start. start is not attempted if stop fails.
+func AgentRestartApp(ctx context.Context, appid string, sink OutputSink) (string, error) {
+	u, err := user.Lookup(appid)
 	if err != nil {
 		return "", err
 	}
 
-	reply, reqError := AgentReq(&req, agentConnect)
-	if reqError != nil {
-		return "", errors.New(reply.Error)
+	if appHasScript(u, "bin/restart") {
+		return runCommand(ctx, u, []string{"bin/restart"}, u.HomeDir, execTimeout(OpRestart), sink)
 	}
 
-	if reply.MsgType != MsgAgentPs {
-		return reply.MsgData, errors.New(reply.Error)
+	stopOutput, err := runCommand(ctx, u, []string{"bin/stop"}, u.HomeDir, execTimeout(OpStop), sink)
+	if err != nil {
+		if err == ErrExecTimeout {
+			return stopOutput, err
+		}
+		return stopOutput, fmt.Errorf("stop failed, not starting: %w", err)
 	}
-
-	return reply.MsgData, nil
+	startOutput, err := runCommand(ctx, u, []string{"bin/start"}, u.HomeDir, execTimeout(OpStart), sink)
+	return stopOutput + startOutput, err
 }
 
-func AgentReqKill(appid string, pid int) (string, error) {
-	var req = AgentMsg{MsgAgentKillPid, appid, fmt.Sprintf("%d", pid), ""}
-	agentConnect, err := SchedulerReqLookup(appid)
+//AgentStatusApp runs ~/bin/status if the app has one and counts the processes of the apps
+//Unix user. Returns a JSON encoded AppStatus. A non-zero exit from ~/bin/status is reported in
+//AppStatus.ExitCode, not as an error.
+func AgentStatusApp(ctx context.Context, appid string) (string, error) {
+	u, err := user.Lookup(appid)
+	if err != nil {
+		return "", err
+	}
+	uid, err := strconv.Atoi(u.Uid)
 	if err != nil {
 		return "", err
 	}
 
-	reply, reqError := AgentReq(&req, agentConnect)
-	if reqError != nil {
-		return "", errors.New(reply.Error)
+	var status AppStatus
+	if appHasScript(u, "bin/status") {
+		status.HasStatusScript = true
+		output, runErr := runCommand(ctx, u, []string{"bin/status"}, u.HomeDir, execTimeout(OpStatus), nil)
+		status.Output = output
+		var exitErr *exec.ExitError
+		if errors.As(runErr, &exitErr) {
+			status.ExitCode = exitErr.ExitCode()
+		} else if runErr != nil {
+			return output, runErr
+		}
 	}
 
-	if reply.MsgType != MsgAgentKillPid {
-		return reply.MsgData, errors.New(reply.Error)
+	procs, err := listProcs(uid)
+	if err != nil {
+		return "", err
 	}
+	status.Processes = len(procs)
+	status.Running = len(procs) > 0
 
-	return reply.MsgData, nil
+	b, err := json.Marshal(status)
+	return string(b), err
 }
 
-func AgentPing(agentConnect string) (bool, error) {
-	var req = AgentMsg{MsgAgentPing, "", "", ""}
+//appHasScript reports whether the optional script at path, relative to the home of u, exists.
+func appHasScript(u *user.User, path string) bool {
+	info, err := os.Stat(filepath.Join(u.HomeDir, path))
+	return err == nil && !info.IsDir()
+}
 
-	reply, reqError := AgentReq(&req, agentConnect)
-	if reqError != nil {
-		return false, errors.New(reply.Error)
+//AgentKillPid sends a signal to a process owned by the Unix user of appid. data is either a
+//bare PID, which receives defaultSignal, or a JSON encoded KillArgs. A MsgAgentForceKillPid
+//passes "KILL" as defaultSignal, which then overrides any signal in KillArgs.
+func AgentKillPid(appid string, data string, defaultSignal string) (string, error) {
+	u, err := user.Lookup(appid)
+	if err != nil {
+		return "", err
 	}
-
-	if reply.MsgType != MsgAgentPingReply {
-		return false, errors.New(reply.Error)
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return "", err
 	}
 
-	return true, nil
-}
+	args := KillArgs{Signal: defaultSignal}
+	if pid, atoiErr := strconv.Atoi(data); atoiErr == nil {
+		args.Pid = pid
+	} else if jsonErr := json.Unmarshal([]byte(data), &args); jsonErr != nil {
+		return "", fmt.Errorf("malformed kill request: %s", data)
+	}
+	if defaultSignal == "KILL" {
+		args.Signal = "KILL"
+	}
 
-func AgentReqStopApp(appid string) (string, error) {
-	var req = AgentMsg{MsgAgentStopApp, appid, "", ""}
-	agentConnect, err := SchedulerReqLookup(appid)
+	sig, err := lookupSignal(args.Signal)
 	if err != nil {
 		return "", err
 	}
-
-	reply, reqError := AgentReq(&req, agentConnect)
-	if reqError != nil {
-		return "", errors.New(reply.Error)
+	if args.Pid <= 1 {
+		return "", fmt.Errorf("invalid pid %d", args.Pid)
 	}
-
-	if reply.MsgType != MsgAgentStopApp {
-		return reply.MsgData, errors.New(reply.Error)
+	if uid == 0 {
+		return "", errors.New("refusing to signal processes of root")
 	}
 
-	return reply.MsgData, nil
+	if err := signalOwnedPid(args.Pid, uid, sig); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Sent SIG%s to process %d", args.Signal, args.Pid), nil
 }
 
-func AgentStartApp(appid string) (string, error) {
+//AgentPs returns a JSON encoded []ProcInfo of the processes whose real uid is the Unix user of
+//appid. listProcs is implemented per platform.
+func AgentPs(appid string) (string, error) {
 	u, err := user.Lookup(appid)
 	if err != nil {
 		return "", err
 	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return "", err
+	}
 
-	return runCommand(u, []string{"bin/start"}, u.HomeDir)
+	procs, err := listProcs(uid)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(procs)
+	return string(b), err
 }
 
-func AgentStopApp(appid string) (string, error) {
-	u, err := user.Lookup(appid)
+//runCommand runs cmdLine as runas in dir. The working directory, environment and credentials
+//are set on the child process only, the agents own working directory is never changed, so any
+//number of commands may run at once. A relative command is looked up in dir. As with the
+//"runuser -" the agent used before, the command is run by the login shell of runas, so its
+//profile is sourced and a script without a #! line runs as a shell script. If it has not
+//finished after timeout its whole process group is killed and the output so far is returned
+//with ErrExecTimeout. If ctx is cancelled first the process group is killed the same way and
+//ctx.Err() is returned. Output is also passed to sink as it is written, unless sink is nil.
+//runCommand returns once the command exits, a daemon it started in the background does not hold
+//it up by keeping stdout or stderr open, see commandOutput.
+func runCommand(ctx context.Context, runas *user.User, cmdLine []string, dir string, timeout time.Duration, sink OutputSink) (string, error) {
+	cred, err := userCredential(runas)
 	if err != nil {
 		return "", err
 	}
 
-	return runCommand(u, []string{"bin/stop"}, u.HomeDir)
-}
+	path := cmdLine[0]
+	if dir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
 
-func changePriv(uid int) {
-	err := syscall.Setreuid(-1, uid)
+	var buf lockedBuffer
+	var stdout, stderr io.Writer = &buf, &buf
+	if sink != nil {
+		stdout = &sinkWriter{&buf, 1, sink}
+		stderr = &sinkWriter{&buf, 2, sink}
+	}
+	var output commandOutput
+	shell := userShell(runas)
+	cmd := exec.Command(shell, "-c", shellQuote(append([]string{path}, cmdLine[1:]...)))
+	//A leading - in its name makes the shell a login shell, as login(1) does it.
+	cmd.Args[0] = "-" + filepath.Base(shell)
+	cmd.Dir = dir //The child changes directory after dropping privileges, so dir is checked as runas.
+	cmd.Env = append(userEnv(runas), "SHELL="+shell)
+	if cmd.Stdout, err = output.pipe(stdout); err == nil {
+		cmd.Stderr, err = output.pipe(stderr)
+	}
 	if err != nil {
-		log.Println("ChangePriv()", err.Error())
+		output.close(0)
+		return "", err
+	}
+	//Run in a process group of its own, so the command and everything it forks can be killed together.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: cred}
+	err = cmd.Start()
+	output.started()
+	if err != nil {
+		output.close(0)
+		return "", err
 	}
 
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	killErr := ErrExecTimeout
+	select {
+	case cmd_err := <-done:
+		output.close(commandDrainWait)
+		return buf.String(), cmd_err
+	case <-timer.C:
+		log.Printf("runCommand(%s, %v) exceeded %s, killing process group %d\n", runas.Username, cmdLine, timeout, cmd.Process.Pid)
+	case <-ctx.Done():
+		killErr = ctx.Err()
+		if config.Debug {
+			log.Printf("runCommand(%s, %v) cancelled, killing process group %d\n", runas.Username, cmdLine, cmd.Process.Pid)
+		}
+	}
+
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	//A process stuck in the kernel may not die at once, so only wait briefly for Wait.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+	output.close(commandDrainWait)
+	return buf.String(), killErr
+}
+
+//commandDrainWait is how long runCommand keeps reading output once the command exited.
+const commandDrainWait = time.Second
+
+//commandOutput holds the pipes a command run by runCommand writes its stdout and stderr to. The
+//agent copies from them itself rather than through exec.Cmd, whose Wait also waits for every
+//process holding the pipes open, such as a daemon started with "app &" that kept them. Once
+//closed the pipes are drained until those processes exit, so their writes do not fail with
+//SIGPIPE, but the output is discarded.
+type commandOutput struct {
+	mu      sync.Mutex
+	closed  bool
+	writers []*os.File
+	copying sync.WaitGroup
 }
-func restorePriv(uid int) {
-	err := syscall.Setreuid(uid, uid)
+
+//commandOutputWriter writes to w until its commandOutput is closed.
+type commandOutputWriter struct {
+	o *commandOutput
+	w io.Writer
+}
+
+func (w commandOutputWriter) Write(p []byte) (int, error) {
+	w.o.mu.Lock()
+	defer w.o.mu.Unlock()
+	if w.o.closed {
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
+
+//pipe returns the write end of a new pipe for the command, what is written to it is copied to w.
+func (o *commandOutput) pipe(w io.Writer) (*os.File, error) {
+	r, pw, err := os.Pipe()
 	if err != nil {
-		log.Println("restorePriv", err.Error())
+		return nil, err
+	}
+	o.writers = append(o.writers, pw)
+	o.copying.Add(1)
+	go func() {
+		defer o.copying.Done()
+		defer r.Close()
+		io.Copy(commandOutputWriter{o, w}, r)
+	}()
+	return pw, nil
+}
+
+//started closes the write ends of the agent once the command was started with its own copies.
+func (o *commandOutput) started() {
+	for _, w := range o.writers {
+		w.Close()
 	}
+	o.writers = nil
+}
 
+//close waits up to wait for the output of the command to be copied, after that nothing more is
+//written to the writers passed to pipe.
+func (o *commandOutput) close(wait time.Duration) {
+	o.started()
+	copied := make(chan bool)
+	go func() {
+		o.copying.Wait()
+		close(copied)
+	}()
+	select {
+	case <-copied:
+	case <-time.After(wait):
+	}
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
 }
 
-//AgentReq encodes and sends a request to the specified agent, returns the reply.
-func AgentReq(req *AgentMsg, agentConnect string) (*AgentMsg, error) {
-	if config.Debug {
-		log.Printf("AgentReq() to %s\n", agentConnect)
+//execTimeout returns the execution deadline for op, from WT_AGENTEXECTIMEOUTS if it has an
+//entry for op, otherwise WT_AGENTEXECTIMEOUT.
+func execTimeout(op string) time.Duration {
+	if secs, ok := config.AgentExecTimeouts[op]; ok {
+		return time.Duration(secs) * time.Second
 	}
+	return time.Duration(config.AgentExecTimeout) * time.Second
+}
 
-	var reply = AgentMsg{MsgAgentError, "", "", ""}
+//sinkWriter copies command output written to fd into both a lockedBuffer and an OutputSink.
+type sinkWriter struct {
+	output *lockedBuffer
+	fd     int
+	sink   OutputSink
+}
 
-	requester, err := zmq.NewSocket(zmq.REQ)
+func (w *sinkWriter) Write(p []byte) (int, error) {
+	w.sink(w.fd, p)
+	return w.output.Write(p)
+}
+
+//userCredential returns the uid, gid and supplementary groups a command run as u needs.
+func userCredential(u *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
 	if err != nil {
-		return &reply, err
+		return nil, err
 	}
-	if config.Debug {
-		log.Println("AgentReq() 0MQ NewSocket(zmq.REQ) ok")
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
 	}
-	defer requester.Close()
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
 
-	connErr := requester.Connect(agentConnect)
-	if connErr != nil {
-		return &reply, connErr
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, err
 	}
-
-	poller := zmq.NewPoller()
-	poller.Add(requester, zmq.POLLIN)
-	jsonOut, jsonErr := json.Marshal(req)
-	if jsonErr != nil {
-		return &reply, jsonErr
+	for _, g := range groups {
+		if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+			cred.Groups = append(cred.Groups, uint32(id))
+		}
 	}
+	return cred, nil
+}
 
-	byteSent, sendErr := requester.SendBytes(jsonOut, 0)
-	if sendErr != nil {
-		log.Println("AgentReq() 0MQ SendBytes:", sendErr)
-		return &reply, sendErr
+//userEnv returns the environment a command run as u starts with. Nothing is inherited from the
+//agent except LANG. PATH is only a default, the profiles read by the login shell may change it.
+func userEnv(u *user.User) []string {
+	lang := os.Getenv("LANG")
+	if lang == "" {
+		lang = "C"
 	}
-	if config.Debug {
-		log.Println("AgentReq() 0MQ SendBytes sent ", byteSent)
+	return []string{
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+		"LANG=" + lang,
 	}
-	//Poll socket for a reply, with a timeout
-	sockets, pollerErr := poller.Poll(time.Duration(config.AgentTimeout) * time.Second)
-	if pollerErr != nil {
-		return &reply, pollerErr // Interrupted by a syscall?
+}
+
+//userShell returns the login shell of u, see loginShell. Users without one, or with nologin or
+//false as theirs, such as accounts only used to run an App, get /bin/sh.
+func userShell(u *user.User) string {
+	shell := loginShell(u.Username)
+	switch filepath.Base(shell) {
+	case ".", "nologin", "false":
+		return "/bin/sh"
 	}
+	return shell
+}
 
-	// Process the server reply. If we didn't get a reply close the socket and fail.
-	if len(sockets) > 0 { //We got something
-		jsonReply, zmqErr := requester.RecvBytes(0)
-		if zmqErr != nil {
-			return &reply, zmqErr
-		}
-		if config.Debug {
-			log.Println("AgentReq() 0MQ Recv msg:", bytes.NewBuffer(jsonReply).String())
-		}
+//shellQuote quotes args into a command line for the shell, each as a single word.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
 
-		jsonErr = json.Unmarshal(jsonReply, &reply)
-		if jsonErr != nil {
-			return &reply, jsonErr
-		}
-		return &reply, nil
+//lockedBuffer is a bytes.Buffer that may be written by a command while runCommand reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
 
-	}
-	if config.Debug {
-		log.Println("Timeout AgentReq() 0MQ poller.")
-	}
-	reply.MsgType = MsgAgentError
-	return &reply, errors.New("timeout")
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
 
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
 }
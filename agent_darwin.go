@@ -1,65 +1,130 @@
 package main
 
 import (
-	"os/user"
+	"bufio"
+	"bytes"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func AgentPs(appid string) (string, error) {
-	u, err := user.Lookup(appid)
+//psFormat selects the ps columns listProcs parses. lstart is always five words and command is
+//last, so both may contain spaces.
+const psFormat = "pid=,ppid=,rss=,state=,time=,lstart=,command="
+
+//listProcs runs ps and returns the processes whose real uid is uid.
+func listProcs(uid int) ([]ProcInfo, error) {
+	cmd := exec.Command("/bin/ps", "-ww", "-U", strconv.Itoa(uid), "-o", psFormat)
+	cmd.Env = []string{"LANG=C", "LC_ALL=C"} //Fixed lstart format.
+	out, err := cmd.Output()
 	if err != nil {
-		return "", err
+		//ps exits 1 when no process matched.
+		if exitErr, ok := err.(*exec.ExitError); ok && len(out) == 0 && exitErr.ExitCode() == 1 {
+			return []ProcInfo{}, nil
+		}
+		return nil, err
 	}
 
-	return runCommand(u, []string{"/bin/ps", "-U", u.Username, "-f", "-x"}, "")
+	procs := []ProcInfo{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		info, err := parsePsLine(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		procs = append(procs, info)
+	}
+	return procs, scanner.Err()
 }
 
-func AgentKillPid(appid string, pid string) (string, error) {
-	u, err := user.Lookup(appid)
-	if err != nil {
-		return "", err
+//parsePsLine parses one line of ps output in psFormat.
+func parsePsLine(line string) (ProcInfo, error) {
+	var info ProcInfo
+	fields := strings.Fields(line)
+	if len(fields) < 11 {
+		return info, fmt.Errorf("malformed ps line %q", line)
 	}
 
-	return runCommand(u, []string{"/bin/kill", pid}, "")
-
-}
-func runCommand(runas *user.User, cmdLine []string, dir string) (string, error) {
 	var err error
-
-	//If they specified a chdir option, do it before executing the command.
-	//We do this after the privilege change to ensure the chdir is done with the permissions of the user that the command will
-	//run as.
-	currentUid := syscall.Getuid()
-	// currentGid := syscall.Getgid()
-	var wantUid int
-	var wantGid int
-	wantUid, err = strconv.Atoi(runas.Uid)
+	if info.Pid, err = strconv.Atoi(fields[0]); err != nil {
+		return info, err
+	}
+	if info.PPid, err = strconv.Atoi(fields[1]); err != nil {
+		return info, err
+	}
+	rss, err := strconv.ParseInt(fields[2], 10, 64)
 	if err != nil {
-		return "", err
+		return info, err
 	}
-
-	if currentUid != wantUid {
-		defer restorePriv(currentUid)
-		changePriv(wantUid)
-
+	info.RSS = rss * 1024
+	info.State = fields[3]
+	if info.CPUSeconds, err = parsePsTime(fields[4]); err != nil {
+		return info, err
+	}
+	lstart := strings.Join(fields[5:10], " ")
+	if info.StartTime, err = time.ParseInLocation("Mon Jan 2 15:04:05 2006", lstart, time.Local); err != nil {
+		return info, err
 	}
-	if dir != "" {
-		var pwd string
-		pwd, err = os.Getwd()
+	info.Cmdline = strings.Join(fields[10:], " ")
+	return info, nil
+}
+
+//parsePsTime converts a ps cputime such as "12:34.56" or "1:02:03.04" to seconds.
+func parsePsTime(s string) (float64, error) {
+	var secs float64
+	for _, part := range strings.Split(s, ":") {
+		n, err := strconv.ParseFloat(part, 64)
 		if err != nil {
-			//log.Println("Getwd()")
-			return "", err
+			return 0, fmt.Errorf("malformed ps time %q", s)
 		}
-		defer os.Chdir(pwd) //Make sure at the end of all this, we go back to our real working directory.
-		err = os.Chdir(dir)
-		if err != nil {
-			log.Println("Chdir(", dir, ")")
-			return "", err
+		secs = secs*60 + n
+	}
+	return secs, nil
+}
+
+//signalOwnedPid sends sig to pid if the real, effective and saved uids of the process are all uid.
+func signalOwnedPid(pid int, uid int, sig syscall.Signal) error {
+	kp, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	if err != nil || kp.Proc.P_pid != int32(pid) {
+		return fmt.Errorf("no such process %d", pid)
+	}
+	for _, id := range []uint32{kp.Eproc.Pcred.P_ruid, kp.Eproc.Ucred.Uid, kp.Eproc.Pcred.P_svuid} {
+		if int(id) != uid {
+			return fmt.Errorf("process %d is not owned by uid %d", pid, uid)
 		}
 	}
+	return syscall.Kill(pid, sig)
+}
 
-	cmd := exec.Command(runUser[0])
-	cmd.Args = runUser
-	output, cmd_err := cmd.CombinedOutput()
-	//Add a timeout mechanism here? Or fancier 0MQ setup that allows concurrent req/rep actions.
-	return bytes.NewBuffer(output).String(), cmd_err
+//localUsers returns the user names in the local directory service.
+func localUsers() ([]string, error) {
+	out, err := exec.Command("/usr/bin/dscl", ".", "-list", "/Users").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+//loginShell returns the login shell of the user name from the local directory service, "" if it
+//has none. Users made in System Settings are not in /etc/passwd.
+func loginShell(name string) string {
+	out, err := exec.Command("/usr/bin/dscl", ".", "-read", "/Users/"+name, "UserShell").Output()
+	if err != nil {
+		return ""
+	}
+	return parseDsclShell(string(out))
+}
+
+//parseDsclShell returns the value of the output of dscl -read for the UserShell attribute,
+//"UserShell: /bin/zsh". Long values are put on a line of their own.
+func parseDsclShell(out string) string {
+	fields := strings.Fields(out)
+	if len(fields) < 2 || fields[0] != "UserShell:" {
+		return ""
+	}
+	return fields[1]
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePsLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want ProcInfo
+	}{
+		{
+			line: "  412     1   5120 Ss     0:01.25 Mon Mar  4 09:15:02 2024     /usr/local/bin/app --port 8080",
+			want: ProcInfo{Pid: 412, PPid: 1, RSS: 5120 * 1024, State: "Ss", CPUSeconds: 1.25,
+				StartTime: time.Date(2024, time.March, 4, 9, 15, 2, 0, time.Local), Cmdline: "/usr/local/bin/app --port 8080"},
+		},
+		{
+			line: "98765   412 102400 R+   1:02:03.50 Tue Dec 31 23:59:59 2024 worker",
+			want: ProcInfo{Pid: 98765, PPid: 412, RSS: 102400 * 1024, State: "R+", CPUSeconds: 3723.5,
+				StartTime: time.Date(2024, time.December, 31, 23, 59, 59, 0, time.Local), Cmdline: "worker"},
+		},
+	}
+	for _, test := range tests {
+		got, err := parsePsLine(test.line)
+		if err != nil {
+			t.Errorf("parsePsLine(%q): %s", test.line, err)
+			continue
+		}
+		if !got.StartTime.Equal(test.want.StartTime) {
+			t.Errorf("parsePsLine(%q).StartTime = %s, want %s", test.line, got.StartTime, test.want.StartTime)
+		}
+		got.StartTime = test.want.StartTime
+		if got != test.want {
+			t.Errorf("parsePsLine(%q) = %+v, want %+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParsePsLineMalformed(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"412 1 5120 Ss 0:01.25 Mon Mar 4 09:15:02",
+		"x 1 5120 Ss 0:01.25 Mon Mar 4 09:15:02 2024 app",
+		"412 1 5120 Ss 0:0x.25 Mon Mar 4 09:15:02 2024 app",
+		"412 1 5120 Ss 0:01.25 Mon Foo 4 09:15:02 2024 app",
+	} {
+		if info, err := parsePsLine(line); err == nil {
+			t.Errorf("parsePsLine(%q) = %+v, want an error", line, info)
+		}
+	}
+}
+
+func TestParseDsclShell(t *testing.T) {
+	tests := []struct {
+		out  string
+		want string
+	}{
+		{"UserShell: /bin/zsh\n", "/bin/zsh"},
+		{"UserShell:\n /usr/local/bin/fish\n", "/usr/local/bin/fish"},
+		{"UserShell: /usr/bin/false\n", "/usr/bin/false"},
+		{"No such key: UserShell\n", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := parseDsclShell(test.out); got != test.want {
+			t.Errorf("parseDsclShell(%q) = %q, want %q", test.out, got, test.want)
+		}
+	}
+}
@@ -2,70 +2,204 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
 	"os"
-	"os/exec"
-	"os/user"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func AgentPs(appid string) (string, error) {
-	u, err := user.Lookup(appid)
+//clockTicks is USER_HZ, the unit of the time fields in /proc/<pid>/stat. It is 100 on every
+//Linux architecture we run on.
+const clockTicks = 100
+
+//listProcs reads /proc and returns the processes whose real uid is uid. Processes that exit
+//while /proc is being read are skipped.
+func listProcs(uid int) ([]ProcInfo, error) {
+	bootTime, err := procBootTime()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.Open("/proc")
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
 	}
 
-	return runCommand(u, []string{"/bin/ps", "-U", u.Username, "u"}, u.HomeDir)
+	procs := []ProcInfo{}
+	for _, name := range names {
+		pid, atoiErr := strconv.Atoi(name)
+		if atoiErr != nil {
+			continue
+		}
+		uids, uidErr := procUids(pid)
+		if uidErr != nil || uids[0] != uid {
+			continue
+		}
+		info, infoErr := procInfo(pid, bootTime)
+		if infoErr != nil {
+			continue
+		}
+		procs = append(procs, info)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Pid < procs[j].Pid })
+	return procs, nil
 }
 
-func AgentKillPid(appid string, pid string) (string, error) {
-	u, err := user.Lookup(appid)
+//procInfo builds the ProcInfo for pid from /proc/<pid>/stat and /proc/<pid>/cmdline.
+func procInfo(pid int, bootTime time.Time) (ProcInfo, error) {
+	info := ProcInfo{Pid: pid}
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
 	if err != nil {
-		return "", err
+		return info, err
+	}
+	//The command name is in parentheses and may itself contain spaces and parentheses.
+	open := bytes.IndexByte(stat, '(')
+	end := bytes.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return info, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	comm := string(stat[open+1 : end])
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 22 {
+		return info, fmt.Errorf("malformed /proc/%d/stat", pid)
 	}
 
-	return runCommand(u, []string{"/bin/kill", pid}, "")
+	info.State = fields[0]
+	info.PPid, _ = strconv.Atoi(fields[1])
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	info.CPUSeconds = float64(utime+stime) / clockTicks
+	started, _ := strconv.ParseInt(fields[19], 10, 64)
+	info.StartTime = bootTime.Add(time.Duration(started) * time.Second / clockTicks)
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+	info.RSS = rss * int64(os.Getpagesize())
+
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return info, err
+	}
+	info.Cmdline = strings.TrimSpace(strings.Replace(string(cmdline), "\x00", " ", -1))
+	if info.Cmdline == "" { //Kernel threads and zombies have no command line.
+		info.Cmdline = "[" + comm + "]"
+	}
+	return info, nil
 }
 
-func runCommand(runas *user.User, cmdLine []string, dir string) (string, error) {
-	var err error
+//procBootTime returns the system boot time from the btime line of /proc/stat.
+func procBootTime() (time.Time, error) {
+	stat, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(stat), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			secs, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	return time.Time{}, errors.New("no btime line in /proc/stat")
+}
 
-	//If they specified a chdir option, do it before executing the command.
-	//We do this after the privilege change to ensure the chdir is done with the permissions of the user that the command will
-	//run as.
-	// currentUid := syscall.Getuid()
-	// // currentGid := syscall.Getgid()
-	// var wantUid int
-	// // var wantGid int
-	// wantUid, err = strconv.Atoi(runas.Uid)
-	// if err != nil {
-	// 	return "", err
-	// }
+//signalOwnedPid sends sig to pid if the real, effective and saved uids of the process are all
+//uid. A pidfd is held across the ownership check, so if pid is recycled in between the signal
+//goes nowhere rather than to another users process.
+func signalOwnedPid(pid int, uid int, sig syscall.Signal) error {
+	pidfd, openErr := unix.PidfdOpen(pid, 0)
+	switch {
+	case openErr == unix.ESRCH:
+		return fmt.Errorf("no such process %d", pid)
+	case openErr == unix.ENOSYS: //Kernel older than 5.3, fall back to kill(2) below.
+	case openErr != nil:
+		return openErr
+	default:
+		defer unix.Close(pidfd)
+	}
 
-	// if currentUid != wantUid {
-	// 	defer restorePriv(currentUid)
-	// 	changePriv(wantUid)
+	uids, err := procUids(pid)
+	if err != nil {
+		return fmt.Errorf("no such process %d", pid)
+	}
+	for _, id := range uids {
+		if id != uid {
+			return fmt.Errorf("process %d is not owned by uid %d", pid, uid)
+		}
+	}
 
-	// }
-	if dir != "" {
-		var pwd string
-		pwd, err = os.Getwd()
-		if err != nil {
-			//log.Println("Getwd()")
-			return "", err
+	if openErr == unix.ENOSYS {
+		return syscall.Kill(pid, sig)
+	}
+	if err := unix.PidfdSendSignal(pidfd, sig, nil, 0); err != nil {
+		if err == unix.ESRCH {
+			return fmt.Errorf("no such process %d", pid)
 		}
-		defer os.Chdir(pwd) //Make sure at the end of all this, we go back to our real working directory.
-		err = os.Chdir(dir)
-		if err != nil {
-			log.Println("Chdir(", dir, ")")
-			return "", err
+		return err
+	}
+	return nil
+}
+
+//procUids returns the real, effective and saved uids of pid from /proc/<pid>/status.
+func procUids(pid int) ([]int, error) {
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "Uid:" {
+			continue
 		}
+		uids := make([]int, 3)
+		for i := range uids {
+			if uids[i], err = strconv.Atoi(fields[i+1]); err != nil {
+				return nil, err
+			}
+		}
+		return uids, nil
 	}
-	var runUser = []string{"/sbin/runuser", "-", "-c", strings.Join(cmdLine, " "), runas.Username}
+	return nil, fmt.Errorf("no Uid line in /proc/%d/status", pid)
+}
 
-	cmd := exec.Command(runUser[0])
-	cmd.Args = runUser
-	output, cmd_err := cmd.CombinedOutput()
-	//Add a timeout mechanism here? Or fancier 0MQ setup that allows concurrent req/rep actions.
-	return bytes.NewBuffer(output).String(), cmd_err
+//localUsers returns the user names in /etc/passwd.
+func localUsers() ([]string, error) {
+	in, err := ioutil.ReadFile("/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(in), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, strings.SplitN(line, ":", 2)[0])
+	}
+	return names, nil
+}
+
+//loginShell returns the login shell of the user name from /etc/passwd, "" if it has none.
+func loginShell(name string) string {
+	in, err := ioutil.ReadFile("/etc/passwd")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(in), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) == 7 && fields[0] == name {
+			return fields[6]
+		}
+	}
+	return ""
 }
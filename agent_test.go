@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//TestRunCommandConcurrent runs two commands at once for users with different home directories
+//and checks each sees its own working directory and $HOME. The script has no #! line, so it
+//also checks that commands are run by a shell.
+func TestRunCommandConcurrent(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("runCommand sets the credentials of the command, which needs root")
+	}
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var users []*user.User
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "webtools-home")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if dir, err = filepath.EvalSymlinks(dir); err != nil {
+			t.Fatal(err)
+		}
+		u := *current
+		u.HomeDir = dir
+		users = append(users, &u)
+	}
+	//Both commands must be running when either reports, so each waits for the other to start.
+	for i, u := range users {
+		peer := users[1-i].HomeDir
+		script := fmt.Sprintf("touch started\nwhile [ ! -e %s/started ]; do sleep 0.05; done\necho \"$(pwd -P) $HOME\"\n", peer)
+		if err := ioutil.WriteFile(filepath.Join(u.HomeDir, "report"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outputs := make([]string, len(users))
+	errs := make([]error, len(users))
+	var wg sync.WaitGroup
+	for i, u := range users {
+		wg.Add(1)
+		go func(i int, u *user.User) {
+			defer wg.Done()
+			outputs[i], errs[i] = runCommand(context.Background(), u, []string{"report"}, u.HomeDir, 10*time.Second, nil)
+		}(i, u)
+	}
+	wg.Wait()
+
+	for i, u := range users {
+		if errs[i] != nil {
+			t.Fatalf("runCommand in %s: %s, output %q", u.HomeDir, errs[i], outputs[i])
+		}
+		//The last line, the profiles sourced by the login shell may print too.
+		lines := strings.Split(strings.TrimSpace(outputs[i]), "\n")
+		want := u.HomeDir + " " + u.HomeDir
+		if got := lines[len(lines)-1]; got != want {
+			t.Errorf("runCommand in %s reported %q, want %q", u.HomeDir, got, want)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+//
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	zmq "github.com/pebbe/zmq4"
+	"log"
+	"sync"
+	"time"
+)
+
+//agentResults is the inproc endpoint workers push their replies to. Every message starts with
+//a frame saying whether it is streamed output or the final reply, then the AppID.
+const agentResults = "inproc://agent-results"
+
+const (
+	resultOutput   = "output"
+	resultReply    = "reply"
+	resultFollowed = "followed" //The final reply of a log follower
+)
+
+//agentKeepalive is how often a worker running a streaming request tells the client it is still
+//working when the command produces no output.
+const agentKeepalive = 5 * time.Second
+
+//agentJob is a request waiting for, or running on, an agentPool worker. envelope holds the
+//ROUTER routing frames that must be sent back in front of the reply, caller and received are
+//recorded in the audit log.
+type agentJob struct {
+	envelope [][]byte
+	query    AgentMsg
+	caller   auditCaller
+	received time.Time
+}
+
+//agentPool accepts agent requests on a ROUTER socket and runs them on a bounded set of worker
+//go routines. Requests for different AppIDs run in parallel, requests for the same AppID are
+//run one at a time in the order they arrived, with at most WT_AGENTMAXQUEUED waiting. Only the
+//go routine running Serve touches the ROUTER socket and the queue state, workers hand their
+//replies back over agentResults.
+//
+//Log follows run for minutes or hours, so they run on go routines of their own, at most
+//WT_AGENTMAXFOLLOWERS at a time, and do not hold up other requests for their AppID.
+//
+//When services begin stopping the pool drains: it stops reading requests, refuses the jobs that
+//have not started, ends the log follows and waits for the workers to send their replies.
+type agentPool struct {
+	jobs      chan *agentJob
+	workers   int
+	idle      int
+	busy      map[string]bool        //AppIDs with a job on a worker
+	pending   map[string][]*agentJob //Jobs waiting for their AppID to become free
+	runnable  []*agentJob            //Jobs whose AppID is free, waiting for a worker
+	followers int
+	following map[string]context.CancelFunc //Running follows by client identity
+}
+
+func newAgentPool(workers int) *agentPool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &agentPool{
+		jobs:      make(chan *agentJob, workers),
+		workers:   workers,
+		idle:      workers,
+		busy:      make(map[string]bool),
+		pending:   make(map[string][]*agentJob),
+		following: make(map[string]context.CancelFunc),
+	}
+}
+
+//Serve binds the ROUTER socket to listen and dispatches requests to the workers. It returns once
+//services are stopping and the pool has drained.
+func (p *agentPool) Serve(listen string) {
+	results, err := zmq.NewSocket(zmq.PULL)
+	if err != nil {
+		log.Fatalln("agentPool.Serve() 0MQ NewSocket:", err)
+	}
+	defer results.Close()
+	results.SetLinger(0)
+	//inproc endpoints must be bound before the workers connect.
+	if err := results.Bind(agentResults); err != nil {
+		log.Fatalln("agentPool.Serve():results.Bind(", agentResults, ")", err.Error())
+	}
+	for i := 0; i < p.workers; i++ {
+		go agentWorker(p.jobs)
+	}
+
+	frontend, err := zmq.NewSocket(zmq.ROUTER)
+	if err != nil {
+		log.Fatalln("agentPool.Serve() 0MQ NewSocket:", err)
+	}
+	defer frontend.Close()
+	//Give the last replies a moment to reach their clients when the socket is closed.
+	frontend.SetLinger(time.Second)
+	//Fail sends to clients that have gone away so their log follows can be stopped.
+	frontend.SetRouterMandatory(1)
+	if err := curveServer(frontend); err != nil {
+		log.Fatalln("agentPool.Serve() CURVE:", err)
+	}
+	if err := frontend.Bind(listen); err != nil {
+		log.Fatalln("agentPool.Serve():frontend.Bind(", listen, ")", err.Error())
+	}
+
+	poller := zmq.NewPoller()
+	poller.Add(frontend, zmq.POLLIN)
+	poller.Add(results, zmq.POLLIN)
+	draining, killed := false, false
+	lastKeepalive := time.Now()
+	for {
+		if !draining && services.stopping.Err() != nil {
+			draining = true
+			p.drain(frontend)
+			poller = zmq.NewPoller()
+			poller.Add(results, zmq.POLLIN)
+		}
+		if draining && p.idle == p.workers && p.followers == 0 {
+			close(p.jobs)
+			return
+		}
+		if draining && !killed && services.killing.Err() != nil {
+			killed = true
+			if running := p.workers - p.idle; running > 0 {
+				services.CutOff(fmt.Sprintf("%d running agent commands", running))
+			}
+		}
+		sockets, err := poller.Poll(shutdownPoll)
+		if err != nil {
+			if config.Debug {
+				log.Println("agentPool.Serve() 0MQ Poll error: ", err.Error())
+			}
+			continue
+		}
+		for _, socket := range sockets {
+			switch socket.Socket {
+			case frontend:
+				p.receive(frontend)
+			case results:
+				p.complete(frontend, results)
+			}
+		}
+		p.dispatch()
+		if time.Since(lastKeepalive) >= agentKeepalive {
+			p.keepalive(frontend)
+			lastKeepalive = time.Now()
+		}
+	}
+}
+
+//receive reads one request from the ROUTER socket and queues it. Pings and malformed
+//requests are answered immediately so they never wait behind a busy app, as are requests for an
+//AppID with WT_AGENTMAXQUEUED requests already waiting, which are refused.
+func (p *agentPool) receive(frontend *zmq.Socket) {
+	frames, metadata, err := frontend.RecvMessageBytesWithMetadata(0, auditMetadata...)
+	if err != nil {
+		if config.Debug {
+			log.Println("agentPool.receive() 0MQ Recv error: ", err.Error())
+		}
+		return
+	}
+	if len(frames) < 2 {
+		return
+	}
+	job := &agentJob{envelope: frames[:len(frames)-1], caller: newAuditCaller(metadata), received: time.Now()}
+
+	if err := json.Unmarshal(frames[len(frames)-1], &job.query); err != nil {
+		if config.Debug {
+			log.Println("agentPool.receive() json Unmarshal: ", err)
+		}
+		AuditMalformed("agent", job.caller, err, job.received)
+		frontend.SendMessage(job.envelope, agentReply(&AgentMsg{MsgType: MsgAgentError, Error: err.Error()}))
+		return
+	}
+	if config.Debug {
+		log.Println("agentPool.receive() 0MQ Recv:", job.query)
+	}
+
+	if job.query.MsgType == MsgAgentPing {
+		reply := AgentHandle(context.Background(), &job.query, nil)
+		AuditAgent(job.caller, &job.query, &reply, job.received)
+		frontend.SendMessage(job.envelope, agentReply(&reply))
+		return
+	}
+	if isFollow(&job.query) {
+		p.follow(frontend, job)
+		return
+	}
+
+	appid := job.query.AppID
+	if p.busy[appid] {
+		//Requests are authorized when they run, so the queue is bounded for those that never will be.
+		if len(p.pending[appid]) >= config.AgentMaxQueued {
+			reply := AgentMsg{MsgType: MsgAgentError, AppID: appid, Error: fmt.Sprintf("AppID %s is busy, try again later", appid)}
+			AuditAgent(job.caller, &job.query, &reply, job.received)
+			frontend.SendMessage(job.envelope, agentReply(&reply))
+			return
+		}
+		p.pending[appid] = append(p.pending[appid], job)
+		return
+	}
+	p.busy[appid] = true
+	p.runnable = append(p.runnable, job)
+}
+
+//complete forwards a workers output or reply to the client. A reply also releases the AppID
+//for its next job.
+func (p *agentPool) complete(frontend *zmq.Socket, results *zmq.Socket) {
+	frames, err := results.RecvMessageBytes(0)
+	if err != nil || len(frames) < 3 {
+		return
+	}
+	identity := string(frames[2])
+	if _, err := frontend.SendMessage(frames[2:]); err != nil {
+		if config.Debug {
+			log.Println("agentPool.complete() 0MQ SendMessage:", err)
+		}
+		if cancel, ok := p.following[identity]; ok {
+			cancel() //The client is gone, stop tailing for it.
+		}
+	}
+	switch string(frames[0]) {
+	case resultFollowed:
+		if cancel, ok := p.following[identity]; ok {
+			cancel()
+			delete(p.following, identity)
+		}
+		p.followers--
+		return
+	case resultOutput:
+		return
+	}
+	p.idle++
+	appid := string(frames[1])
+
+	if next := p.pending[appid]; len(next) > 0 {
+		p.runnable = append(p.runnable, next[0])
+		if len(next) == 1 {
+			delete(p.pending, appid)
+		} else {
+			p.pending[appid] = next[1:]
+		}
+		return
+	}
+	delete(p.busy, appid)
+}
+
+//follow starts a log follow on its own go routine, or refuses it when WT_AGENTMAXFOLLOWERS
+//follows are already running.
+func (p *agentPool) follow(frontend *zmq.Socket, job *agentJob) {
+	identity := string(job.envelope[0])
+	refuse := func(reason string) {
+		reply := AgentMsg{MsgType: MsgAgentError, AppID: job.query.AppID, Error: reason}
+		AuditAgent(job.caller, &job.query, &reply, job.received)
+		frontend.SendMessage(job.envelope, agentReply(&reply))
+	}
+	if p.followers >= config.AgentMaxFollowers {
+		refuse("too many log followers, try again later")
+		return
+	}
+	if _, ok := p.following[identity]; ok {
+		refuse("already following logs")
+		return
+	}
+	ctx, cancel := context.WithCancel(services.stopping)
+	p.followers++
+	p.following[identity] = cancel
+	go agentFollower(ctx, job)
+}
+
+//isFollow reports whether query is a streamed logs request with Follow set.
+func isFollow(query *AgentMsg) bool {
+	if query.MsgType != MsgAgentLogs || !query.Stream {
+		return false
+	}
+	var args LogArgs
+	if err := json.Unmarshal([]byte(query.MsgData), &args); err != nil {
+		return false //Let AgentLogs report it.
+	}
+	return args.Follow
+}
+
+//drain refuses the jobs that have not started and ends the log follows, see agentPool.
+func (p *agentPool) drain(frontend *zmq.Socket) {
+	log.Println("agentPool.drain(): shutting down,", p.workers-p.idle, "requests running")
+	refuse := func(job *agentJob) {
+		reply := AgentMsg{MsgType: MsgAgentError, AppID: job.query.AppID, Error: "agent is shutting down"}
+		AuditAgent(job.caller, &job.query, &reply, job.received)
+		frontend.SendMessage(job.envelope, agentReply(&reply))
+	}
+	for _, job := range p.runnable {
+		refuse(job)
+		delete(p.busy, job.query.AppID)
+	}
+	p.runnable = nil
+	for appid, jobs := range p.pending {
+		for _, job := range jobs {
+			refuse(job)
+		}
+		delete(p.pending, appid)
+	}
+	for _, cancel := range p.following {
+		cancel()
+	}
+}
+
+//keepalive tells the clients of queued streaming requests they are still waiting, so they do
+//not take an agent busy with their AppID for an unreachable one.
+func (p *agentPool) keepalive(frontend *zmq.Socket) {
+	send := func(job *agentJob) {
+		if job.query.Stream {
+			frontend.SendMessage(job.envelope, agentReply(&AgentMsg{MsgType: MsgAgentOutput, AppID: job.query.AppID}))
+		}
+	}
+	for _, job := range p.runnable {
+		send(job)
+	}
+	for _, jobs := range p.pending {
+		for _, job := range jobs {
+			send(job)
+		}
+	}
+}
+
+//dispatch hands runnable jobs to idle workers.
+func (p *agentPool) dispatch() {
+	for p.idle > 0 && len(p.runnable) > 0 {
+		p.jobs <- p.runnable[0]
+		p.runnable = p.runnable[1:]
+		p.idle--
+	}
+}
+
+//agentWorker runs jobs and pushes [kind, AppID, envelope..., message] to agentResults. The
+//commands of a job are killed when the shutdown grace period ends.
+func agentWorker(jobs <-chan *agentJob) {
+	sender := resultSender("agentWorker()")
+	defer sender.Close()
+
+	for job := range jobs {
+		runAgentJob(services.killing, sender, resultReply, job)
+	}
+}
+
+//agentFollower runs a single log follow job until it ends or ctx is cancelled.
+func agentFollower(ctx context.Context, job *agentJob) {
+	sender := resultSender("agentFollower()")
+	defer sender.Close()
+
+	runAgentJob(ctx, sender, resultFollowed, job)
+}
+
+//resultSender returns a PUSH socket connected to agentResults.
+func resultSender(who string) *zmq.Socket {
+	sender, err := zmq.NewSocket(zmq.PUSH)
+	if err != nil {
+		log.Fatalln(who, "0MQ NewSocket:", err)
+	}
+	if err := sender.Connect(agentResults); err != nil {
+		log.Fatalln(who, "sender.Connect(", agentResults, ")", err.Error())
+	}
+	sender.SetLinger(0)
+	return sender
+}
+
+//runAgentJob runs job and pushes its output and then its reply, tagged with kind, to sender.
+func runAgentJob(ctx context.Context, sender *zmq.Socket, kind string, job *agentJob) {
+	send := func(kind string, msg *AgentMsg) {
+		if _, err := sender.SendMessage(kind, job.query.AppID, job.envelope, agentReply(msg)); err != nil {
+			log.Println("runAgentJob() 0MQ SendMessage:", err)
+		}
+	}
+
+	if !job.query.Stream {
+		reply := AgentHandle(ctx, &job.query, nil)
+		AuditAgent(job.caller, &job.query, &reply, job.received)
+		send(kind, &reply)
+		return
+	}
+
+	//sendMu serializes use of sender between this go routine, the go routines copying command
+	//output and the keepalive ticker.
+	var sendMu sync.Mutex
+	finished := false //Output that arrives after the reply, e.g. from a killed command, is dropped.
+	sink := func(fd int, p []byte) {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		if !finished {
+			send(resultOutput, &AgentMsg{MsgType: MsgAgentOutput, AppID: job.query.AppID, MsgData: string(p), Fd: fd})
+		}
+	}
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(agentKeepalive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sink(0, nil)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	reply := AgentHandle(ctx, &job.query, sink)
+	close(stop)
+	AuditAgent(job.caller, &job.query, &reply, job.received)
+	sendMu.Lock()
+	finished = true
+	send(kind, &reply)
+	sendMu.Unlock()
+}
+
+//agentReply marshals a message the agent sends to a client, with Proto set, so the client
+//recognizes every reply of this agent, errors and refusals included, as ProtocolVersion.
+func agentReply(msg *AgentMsg) []byte {
+	msg.Proto = ProtocolVersion
+	b, _ := json.Marshal(msg)
+	return b
+}
@@ -0,0 +1,35 @@
+//
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//writeFileAtomic replaces the file at path with data. The data is written to a temporary file
+//in the same directory which is then renamed over path, so readers never see a partially
+//written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, tmpErr := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if tmpErr != nil {
+		return tmpErr
+	}
+	defer os.Remove(tmp.Name()) //No-op once the rename succeeds.
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,355 @@
+//
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//AuditRecord is a single entry of the audit log, one per request handled by the agent or
+//scheduler. User is the user name the request was sent with, Key the CURVE public key of the
+//client if WT_CURVE is set and Peer its address. Args holds the arguments of the request, such
+//as the pid and signal of a kill, never the password. User, AppID, Args and Error are cut to
+//auditMaxField bytes. Op is "malformed" for a request that is
+//not valid JSON. Status is ok, denied, notfound, error, exectimeout or unsupported, Seconds is the
+//time taken to handle the request.
+type AuditRecord struct {
+	Time     time.Time
+	Service  string //"agent" or "scheduler"
+	User     string
+	Key      string `json:",omitempty"`
+	Peer     string `json:",omitempty"`
+	AppID    string `json:",omitempty"`
+	Op       string
+	Args     string `json:",omitempty"`
+	Status   string
+	ExitCode int    `json:",omitempty"`
+	Error    string `json:",omitempty"`
+	Seconds  float64
+}
+
+//auditCaller is who sent a request, as recorded in AuditRecord.
+type auditCaller struct {
+	Peer string
+	Key  string
+}
+
+//auditMetadata are the 0MQ message properties read for auditCaller.
+var auditMetadata = []string{"Peer-Address", "User-Id"}
+
+//newAuditCaller returns the auditCaller of a message received with auditMetadata. User-Id is
+//the client public key when the socket uses CURVE.
+func newAuditCaller(metadata map[string]string) auditCaller {
+	caller := auditCaller{Peer: metadata["Peer-Address"]}
+	if config.Curve {
+		caller.Key = metadata["User-Id"]
+	}
+	return caller
+}
+
+//auditUnknownOp is the AuditRecord.Op of requests of a MsgType without a name, their type is
+//kept in Args. The client picks the MsgType, so the Op, which is a label of the metrics, must not
+//be made from it.
+const auditUnknownOp = "unknown"
+
+//auditAgentOps names the agent requests in AuditRecord.Op.
+var auditAgentOps = map[int]string{
+	MsgAgentStartApp:     "start",
+	MsgAgentStopApp:      "stop",
+	MsgAgentPs:           "ps",
+	MsgAgentPing:         "ping",
+	MsgAgentKillPid:      "kill",
+	MsgAgentForceKillPid: "forcekill",
+	MsgAgentRestartApp:   "restart",
+	MsgAgentStatusApp:    "status",
+	MsgAgentLogs:         "logs",
+}
+
+//auditSchedOps names the scheduler requests in AuditRecord.Op.
+var auditSchedOps = map[int]string{
+	SchedLookup:    "lookup",
+	SchedSet:       "set",
+	SchedPing:      "ping",
+	SchedUnset:     "unset",
+	SchedRegister:  "register",
+	SchedHeartbeat: "heartbeat",
+	SchedList:      "list",
+}
+
+//auditLog is the open audit log file of the agent or scheduler service.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+//AuditLog is the audit log of the services, nil if WT_AUDITLOGPATH is empty.
+var AuditLog *auditLog
+
+var auditLogOnce sync.Once
+
+//StartAuditLog opens the audit log at WT_AUDITLOGPATH for the agent and scheduler services. It
+//is safe to call once per service, the services share the log when run in one process.
+func StartAuditLog() {
+	auditLogOnce.Do(func() {
+		if config.AuditLogPath == "" {
+			log.Println("WT_AUDITLOGPATH is empty, requests are not audited")
+			return
+		}
+		l := &auditLog{}
+		if err := l.open(); err != nil {
+			log.Fatalln("StartAuditLog: ", err)
+		}
+		AuditLog = l
+	})
+}
+
+//open opens WT_AUDITLOGPATH for appending, creating it if needed.
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(config.AuditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+//rotate renames the log to WT_AUDITLOGPATH.1, shifting older files up to WT_AUDITKEEP and
+//removing the oldest, and starts a new log.
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	path := config.AuditLogPath
+	if config.AuditKeep < 1 {
+		os.Remove(path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", path, config.AuditKeep))
+		for i := config.AuditKeep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		}
+		if err := os.Rename(path, path+".1"); err != nil {
+			log.Println("auditLog.rotate(): ", err)
+		}
+	}
+	return l.open()
+}
+
+//Write appends rec to the log as a line of JSON, rotating the log first if it would grow past
+//WT_AUDITMAXSIZE megabytes. Errors are logged, a request is never failed because of them.
+func (l *auditLog) Write(rec *AuditRecord) {
+	if l == nil {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Println("auditLog.Write(): ", err)
+		return
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		//A failed rotation, try again.
+		if err := l.open(); err != nil {
+			log.Println("auditLog.Write(): ", err)
+			return
+		}
+	}
+	if l.size > 0 && l.size+int64(len(b)) > config.AuditMaxSize*1024*1024 {
+		if err := l.rotate(); err != nil {
+			log.Println("auditLog.Write() rotate: ", err)
+			l.file = nil
+			return
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		log.Println("auditLog.Write(): ", err)
+	}
+}
+
+//AuditAgent records an agent request and its reply in the audit log and Metrics. start is when
+//the request was received.
+func AuditAgent(caller auditCaller, query *AgentMsg, reply *AgentMsg, start time.Time) {
+	rec := AuditRecord{Time: start, Service: "agent", User: query.User, Key: caller.Key, Peer: caller.Peer,
+		AppID: query.AppID, Op: auditAgentOps[query.MsgType], Args: query.MsgData, Status: "ok",
+		ExitCode: reply.ExitCode, Error: reply.Error, Seconds: time.Since(start).Seconds()}
+	if rec.Op == "" {
+		rec.Op, rec.Args = auditUnknownOp, fmt.Sprintf("type=%d", query.MsgType)
+	}
+	switch reply.MsgType {
+	case MsgAgentDenied:
+		rec.Status = "denied"
+	case MsgAgentError:
+		rec.Status = "error"
+	case MsgAgentExecTimeout:
+		rec.Status = "exectimeout"
+	case MsgAgentUnsupported:
+		rec.Status = "unsupported"
+	}
+	auditWrite(&rec)
+}
+
+//AuditScheduler records a scheduler request and its reply in the audit log and Metrics. start is
+//when the request was received.
+func AuditScheduler(caller auditCaller, query *SchedulerMsg, reply *SchedulerMsg, start time.Time) {
+	rec := AuditRecord{Time: start, Service: "scheduler", User: query.User, Key: caller.Key, Peer: caller.Peer,
+		AppID: query.AppID, Op: auditSchedOps[query.MsgType], Args: auditSchedArgs(query), Status: "ok",
+		Error: reply.Error, Seconds: time.Since(start).Seconds()}
+	if rec.Op == "" {
+		rec.Op, rec.Args = auditUnknownOp, fmt.Sprintf("type=%d", query.MsgType)
+	}
+	switch reply.MsgType {
+	case SchedDenied:
+		rec.Status = "denied"
+	case SchedNotFound:
+		rec.Status = "notfound"
+	case SchedError:
+		rec.Status = "error"
+	case SchedUnknown:
+		rec.Status = "unsupported"
+	}
+	auditWrite(&rec)
+}
+
+//AuditMalformed records a request to service, "agent" or "scheduler", that could not be decoded
+//in the audit log and Metrics, err is why. start is when the request was received.
+func AuditMalformed(service string, caller auditCaller, err error, start time.Time) {
+	rec := AuditRecord{Time: start, Service: service, Key: caller.Key, Peer: caller.Peer, Op: "malformed",
+		Status: "error", Error: err.Error(), Seconds: time.Since(start).Seconds()}
+	auditWrite(&rec)
+}
+
+//auditMaxField is the most bytes of a field sent by the client, such as Args, an AuditRecord
+//keeps. Any peer can send a request, denied or not, so the fields are cut to keep the records
+//short.
+const auditMaxField = 256
+
+//auditMaxLine is the longest line ReadAudit reads, longer lines are skipped.
+const auditMaxLine = 64 * 1024
+
+//auditWrite counts rec in Metrics and appends it to the AuditLog. Successful pings and
+//heartbeats, sent every few seconds by agents and the scheduler, are only counted unless
+//WT_AUDITPINGS is set.
+func auditWrite(rec *AuditRecord) {
+	Metrics.Request(rec.Service, rec.Op, rec.Status)
+	if !config.AuditPings && rec.Status == "ok" && (rec.Op == "ping" || rec.Op == "heartbeat") {
+		return
+	}
+	rec.User = auditTruncate(rec.User)
+	rec.AppID = auditTruncate(rec.AppID)
+	rec.Args = auditTruncate(rec.Args)
+	rec.Error = auditTruncate(rec.Error)
+	AuditLog.Write(rec)
+}
+
+//auditTruncate cuts s to auditMaxField bytes, at a character boundary, marking the cut with "...".
+func auditTruncate(s string) string {
+	if len(s) <= auditMaxField {
+		return s
+	}
+	s = s[:auditMaxField]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + "..."
+}
+
+//auditSchedArgs returns the arguments of a scheduler request for AuditRecord.Args.
+func auditSchedArgs(query *SchedulerMsg) string {
+	switch query.MsgType {
+	case SchedSet:
+		agents := []string{query.Address}
+		if len(query.AppAgents) > 0 {
+			agents = nil
+			for _, a := range query.AppAgents {
+				agents = append(agents, a.Address)
+			}
+		}
+		args := strings.Join(agents, ",")
+		if query.Tags != nil {
+			args += " tags=" + strings.Join(query.Tags, ",")
+		}
+		return args
+	case SchedRegister:
+		return fmt.Sprintf("%s hostname=%s version=%s apps=%d", query.Address, query.Hostname, query.Version, len(query.AppIDs))
+	case SchedHeartbeat, SchedList:
+		return query.Address
+	}
+	return ""
+}
+
+//auditFiles returns the audit log and its rotated files, oldest first.
+func auditFiles() []string {
+	var files []string
+	for i := config.AuditKeep; i > 0; i-- {
+		files = append(files, fmt.Sprintf("%s.%d", config.AuditLogPath, i))
+	}
+	return append(files, config.AuditLogPath)
+}
+
+//ReadAudit calls fn, oldest first, for the records of the audit log and its rotated files for
+//appid, or every AppID if it is empty, from since on. Lines that are not AuditRecords, or are
+//too long to be, are skipped.
+func ReadAudit(appid string, since time.Time, fn func(*AuditRecord)) error {
+	found := false
+	for _, path := range auditFiles() {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		err = readAuditFile(f, appid, since, fn)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	if !found {
+		return fmt.Errorf("no audit log at %s", config.AuditLogPath)
+	}
+	return nil
+}
+
+//readAuditFile calls fn for the records in r, see ReadAudit. Lines longer than auditMaxLine, which
+//auditWrite does not write, are skipped.
+func readAuditFile(r io.Reader, appid string, since time.Time, fn func(*AuditRecord)) error {
+	reader := bufio.NewReaderSize(r, auditMaxLine)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			line = nil
+		}
+		var rec AuditRecord
+		if len(line) > 0 && json.Unmarshal(line, &rec) == nil &&
+			(appid == "" || rec.AppID == appid) && !rec.Time.Before(since) {
+			fn(&rec)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+//TestVetOtherOS vets the package, tests included, for the operating systems it supports other
+//than the one the tests run on, so agent_darwin.go and agent_linux.go are checked wherever CI
+//runs. 0MQ is a cgo package, so cgo stays enabled for the cross build.
+func TestVetOtherOS(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go vet")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go tool:", err)
+	}
+	for _, goos := range []string{"linux", "darwin"} {
+		if goos == runtime.GOOS {
+			continue
+		}
+		cmd := exec.Command(goTool, "vet", ".")
+		cmd.Env = append(os.Environ(), "GOOS="+goos, "CGO_ENABLED=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("GOOS=%s go vet: %s\n%s", goos, err, out)
+		}
+	}
+}
@@ -2,10 +2,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/ictusa/webtools/client"
 	zmq "github.com/pebbe/zmq4"
+	"golang.org/x/term"
+	"io"
 	"log"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 )
 
 const (
@@ -22,17 +33,57 @@ const (
 	CliStop
 	CliVersion
 	CliService
+	CliUser
+	CliRestart
+	CliStatus
+	CliLogs
+	CliKeygen
+	CliAudit
+)
+
+// Exit codes of the webtools CLI. When a command run on the content server fails with exit
+// code N, webtools exits with N if it is between 1 and 63 and with ExitCommandFailed otherwise,
+// so codes from 64 up always mean a webtools error.
+const (
+	ExitOK                   = 0
+	ExitCommandFailed        = 63 // Remote command failed with an exit code outside 1-63, or was killed
+	ExitUsage                = 64 // Bad command line
+	ExitFailure              = 65 // Any other failure
+	ExitSchedulerUnreachable = 66 // No reply from the scheduler
+	ExitAppNotFound          = 67 // The scheduler does not know the AppID
+	ExitAgentTimeout         = 68 // No reply from the agent
+	ExitUnauthorized         = 69 // Bad credentials or operation not permitted
+	ExitExecTimeout          = 70 // Remote command exceeded its execution timeout and was killed
+	ExitUnsupported          = 71 // The agent or scheduler is too old for the request
 )
 
 // ParseCli implements a very naive parser for command line arguments.
+// --host=<host>[,<host>...] may be given anywhere, see cliHosts.
 func ParseCli(cmds []string) {
 	if config.Debug {
 		log.Println("ParseCli(", cmds, ")")
 	}
-	parsecli(CliInit, cmds)
+	var rest []string
+	for _, arg := range cmds {
+		if strings.HasPrefix(arg, "--host=") {
+			cliHosts = append(cliHosts, strings.Split(strings.TrimPrefix(arg, "--host="), ",")...)
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	if len(rest) == 0 {
+		DoHelp()
+		return
+	}
+	parsecli(CliInit, rest)
 
 }
 
+// cliHosts selects the agents of an App that commands run on, by connect string or host name.
+// Without it start, stop, restart, status and ps run on every agent, kill and logs refuse to run
+// when there is more than one.
+var cliHosts []string
+
 // parsecli is the recursive portion of the parser, should be called by ParseCli only.
 func parsecli(state int, cmds []string) {
 	var statemap = map[int]string{
@@ -49,6 +100,12 @@ func parsecli(state int, cmds []string) {
 		CliStart:           "CliStart",
 		CliStop:            "CliStop",
 		CliVersion:         "CliVersion",
+		CliUser:            "CliUser",
+		CliRestart:         "CliRestart",
+		CliStatus:          "CliStatus",
+		CliLogs:            "CliLogs",
+		CliKeygen:          "CliKeygen",
+		CliAudit:           "CliAudit",
 	}
 	if config.Debug {
 		log.Println("parsecli(", statemap[state], ",", cmds, ")")
@@ -81,12 +138,31 @@ func parsecli(state int, cmds []string) {
 		case cmds[0] == "stop":
 			parsecli(CliStop, cmds[1:len(cmds)])
 
+		case cmds[0] == "restart":
+			parsecli(CliRestart, cmds[1:len(cmds)])
+
+		case cmds[0] == "status":
+			parsecli(CliStatus, cmds[1:len(cmds)])
+
+		case cmds[0] == "logs":
+			parsecli(CliLogs, cmds[1:len(cmds)])
+
 		case cmds[0] == "ps":
 			parsecli(CliPs, cmds[1:len(cmds)])
 
+		case cmds[0] == "user":
+			parsecli(CliUser, cmds[1:len(cmds)])
+
+		case cmds[0] == "keygen":
+			parsecli(CliKeygen, cmds[1:len(cmds)])
+
+		case cmds[0] == "audit":
+			parsecli(CliAudit, cmds[1:len(cmds)])
+
 		default:
 			fmt.Println("webtools: unknown command:", cmds[0])
 			fmt.Println("Run 'webtools help' for usage information.")
+			ExitStatus = ExitUsage
 		} // state == CliInit
 
 	case state == CliVersion:
@@ -94,35 +170,58 @@ func parsecli(state int, cmds []string) {
 
 	case state == CliPing:
 		switch {
-		case cmds[0] == "agent":
+		case len(cmds) > 0 && cmds[0] == "agent":
 			parsecli(CliPingAgent, cmds[1:len(cmds)])
-		case cmds[0] == "scheduler":
+		case len(cmds) > 0 && cmds[0] == "scheduler":
 			parsecli(CliPingSched, cmds[1:len(cmds)])
-
+		default:
+			usage("Usage: webtools ping scheduler | webtools ping agent <hostname>")
 		} // state == CliPing
 
 	case state == CliPingAgent:
 		if len(cmds) != 1 {
-			log.Fatalln("Usage: webtools ping agent <hostname>")
+			usage("Usage: webtools ping agent <hostname>")
 		}
 		DoPingAgent(cmds[0])
 	case state == CliPingSched:
+		if len(cmds) != 0 {
+			usage("Usage: webtools ping scheduler")
+		}
 		DoPingSched()
 
 	case state == CliKill:
+		signal := "TERM"
+		for len(cmds) > 1 && strings.HasPrefix(cmds[0], "-") {
+			var err error
+			switch {
+			case strings.HasPrefix(cmds[0], "--signal="):
+				signal, err = ParseSignal(strings.TrimPrefix(cmds[0], "--signal="))
+			case cmds[0] == "-s" || cmds[0] == "--signal":
+				signal, err = ParseSignal(cmds[1])
+				cmds = cmds[1:len(cmds)]
+			default:
+				signal, err = ParseSignal(strings.TrimPrefix(cmds[0], "-"))
+			}
+			if err != nil {
+				usage("Usage: webtools kill [-<signal>|--signal=<signal>] <pid>, ", err.Error())
+			}
+			cmds = cmds[1:len(cmds)]
+		}
 		if len(cmds) != 1 {
-			log.Fatalln("Usage: webtools kill <pid>")
+			usage("Usage: webtools kill [-<signal>|--signal=<signal>] <pid>")
 		}
 
 		if pid, err := strconv.Atoi(cmds[0]); err == nil {
-			DoKill(pid)
+			DoKill(pid, signal)
 		} else {
-			log.Fatalln("Usage: webtools kill <pid>, ", err.Error())
+			usage("Usage: webtools kill [-<signal>|--signal=<signal>] <pid>, ", err.Error())
 		}
 
 	case state == CliScheduler:
 		if len(cmds) < 1 {
 			DoHelp()
+			ExitStatus = ExitUsage
+			return
 		}
 		switch {
 		case cmds[0] == "lookup":
@@ -131,12 +230,52 @@ func parsecli(state int, cmds []string) {
 			} else {
 				DoSchedLookup(config.AppId)
 			}
+		case cmds[0] == "set":
+			var tags []string
+			if len(cmds) == 4 && strings.HasPrefix(cmds[3], "--tags=") {
+				tags = []string{}
+				if t := strings.TrimPrefix(cmds[3], "--tags="); t != "" {
+					tags = strings.Split(t, ",")
+				}
+				cmds = cmds[0:3]
+			}
+			if len(cmds) != 3 {
+				usage("Usage: webtools scheduler set <appid> <agent addr>[,<agent addr>...] [--tags=tag,...]")
+			}
+			DoSchedSet(cmds[1], strings.Split(cmds[2], ","), tags)
+		case cmds[0] == "import":
+			if len(cmds) != 2 {
+				usage("Usage: webtools scheduler import <scheduler.json>")
+			}
+			DoSchedImport(cmds[1])
+		case cmds[0] == "unset":
+			if len(cmds) != 2 {
+				usage("Usage: webtools scheduler unset <appid>")
+			}
+			DoSchedUnset(cmds[1])
+		case cmds[0] == "list":
+			pattern, agent, jsonOut := "", "", false
+			for _, arg := range cmds[1:len(cmds)] {
+				switch {
+				case arg == "--json":
+					jsonOut = true
+				case strings.HasPrefix(arg, "--agent="):
+					agent = strings.TrimPrefix(arg, "--agent=")
+				case !strings.HasPrefix(arg, "-") && pattern == "":
+					pattern = arg
+				default:
+					usage("Usage: webtools scheduler list [glob] [--agent=<agent addr>] [--json]")
+				}
+			}
+			DoSchedList(pattern, agent, jsonOut)
 		default:
 			DoHelp()
+			ExitStatus = ExitUsage
 		}
 	case state == CliService:
 		if len(cmds) < 1 {
 			DoHelp()
+			ExitStatus = ExitUsage
 			return
 		}
 		switch {
@@ -144,18 +283,57 @@ func parsecli(state int, cmds []string) {
 			DoStartAgent()
 		case cmds[0] == "scheduler":
 			DoStartScheduler()
+		case cmds[0] == "gateway":
+			DoStartGateway()
 		default:
 			DoHelp()
+			ExitStatus = ExitUsage
 			return
 		}
 		if len(cmds) > 1 {
 			parsecli(CliService, cmds[1:len(cmds)])
 		}
+	case state == CliUser:
+		if len(cmds) < 1 {
+			DoHelp()
+			ExitStatus = ExitUsage
+			return
+		}
+		switch {
+		case cmds[0] == "add":
+			if len(cmds) != 4 {
+				usage("Usage: webtools user add <user> <role[,role...]> <appid[,appid...]>")
+			}
+			DoUserAdd(cmds[1], strings.Split(cmds[2], ","), strings.Split(cmds[3], ","))
+		case cmds[0] == "del":
+			if len(cmds) != 2 {
+				usage("Usage: webtools user del <user>")
+			}
+			DoUserDel(cmds[1])
+		case cmds[0] == "passwd":
+			if len(cmds) != 2 {
+				usage("Usage: webtools user passwd <user>")
+			}
+			DoUserPasswd(cmds[1])
+		default:
+			DoHelp()
+			ExitStatus = ExitUsage
+		}
+
 	case state == CliHelp:
 		DoHelp()
 
 	case state == CliPs:
-		DoPs()
+		jsonOut := false
+		for _, arg := range cmds {
+			switch {
+			case arg == "--json":
+				jsonOut = true
+			default:
+				usage("Usage: webtools ps [--json]")
+			}
+		}
+		DoPs(jsonOut)
 
 	case state == CliStart:
 		DoStart()
@@ -163,18 +341,148 @@ func parsecli(state int, cmds []string) {
 	case state == CliStop:
 		DoStop()
 
+	case state == CliRestart:
+		DoRestart()
+
+	case state == CliStatus:
+		DoStatus()
+
+	case state == CliKeygen:
+		switch len(cmds) {
+		case 0:
+			DoKeygen("")
+		case 1:
+			DoKeygen(cmds[0])
+		default:
+			usage("Usage: webtools keygen [file]")
+		}
+
+	case state == CliAudit:
+		appid, since, jsonOut := "", time.Time{}, false
+		for len(cmds) > 0 {
+			var arg, value string
+			switch {
+			case cmds[0] == "--json":
+				jsonOut = true
+				cmds = cmds[1:len(cmds)]
+				continue
+			case strings.Contains(cmds[0], "="):
+				parts := strings.SplitN(cmds[0], "=", 2)
+				arg, value = parts[0], parts[1]
+				cmds = cmds[1:len(cmds)]
+			case len(cmds) > 1:
+				arg, value = cmds[0], cmds[1]
+				cmds = cmds[2:len(cmds)]
+			default:
+				usage("Usage: webtools audit [--app <Appid>] [--since <duration>] [--json]")
+			}
+			switch arg {
+			case "--app":
+				appid = value
+			case "--since":
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					usage("Usage: webtools audit [--app <Appid>] [--since <duration>] [--json], ", err.Error())
+				}
+				since = time.Now().Add(-d)
+			default:
+				usage("Usage: webtools audit [--app <Appid>] [--since <duration>] [--json]")
+			}
+		}
+		DoAudit(appid, since, jsonOut)
+
+	case state == CliLogs:
+		args := LogArgs{Lines: 10}
+		for len(cmds) > 0 && strings.HasPrefix(cmds[0], "-") {
+			switch {
+			case cmds[0] == "-f" || cmds[0] == "--follow":
+				args.Follow = true
+			case cmds[0] == "-n" && len(cmds) > 1:
+				n, err := strconv.Atoi(cmds[1])
+				if err != nil || n < 0 {
+					usage("Usage: webtools logs [-f] [-n <lines>] [file]")
+				}
+				args.Lines = n
+				cmds = cmds[1:len(cmds)]
+			default:
+				usage("Usage: webtools logs [-f] [-n <lines>] [file]")
+			}
+			cmds = cmds[1:len(cmds)]
+		}
+		if len(cmds) > 1 {
+			usage("Usage: webtools logs [-f] [-n <lines>] [file]")
+		}
+		if len(cmds) == 1 {
+			args.File = cmds[0]
+		}
+		DoLogs(args)
+
 	} //state switch
 }
+// usage prints a usage message and exits with ExitUsage.
+func usage(v ...interface{}) {
+	fmt.Fprintln(os.Stderr, v...)
+	osExit(ExitUsage)
+}
+
+// osExit is os.Exit, replaced by the tests to see the exit status of usage.
+var osExit = os.Exit
+
+// exitCode maps an error returned by the scheduler and agent requests to a CLI exit code.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case err == ErrSchedulerTimeout:
+		return ExitSchedulerUnreachable
+	case err == ErrAppNotFound:
+		return ExitAppNotFound
+	case err == ErrAgentTimeout, err == ErrAgentDead:
+		return ExitAgentTimeout
+	case err == ErrUnauthorized, err == ErrForbidden:
+		return ExitUnauthorized
+	case err == ErrExecTimeout:
+		return ExitExecTimeout
+	case err == ErrAgentUnsupported, err == ErrSchedulerUnsupported:
+		return ExitUnsupported
+	}
+	if _, ok := err.(*TooOldError); ok {
+		return ExitUnsupported
+	}
+	if _, ok := err.(usageError); ok {
+		return ExitUsage
+	}
+	if cmdErr, ok := err.(*CommandError); ok {
+		if cmdErr.ExitCode >= 1 && cmdErr.ExitCode < ExitCommandFailed {
+			return cmdErr.ExitCode
+		}
+		return ExitCommandFailed
+	}
+	return ExitFailure
+}
+
 func DoStartAgent() {
+	StartPasswordDB()
+	StartCurveAuth()
+	StartAuditLog()
+	StartMetrics()
 	ServicesRunning = true
-	go AgentService()
+	services.Go(AgentService)
 }
 func DoStartScheduler() {
+	StartPasswordDB()
+	StartAuditLog()
+	StartMetrics()
+	StartCurveAuth()
 	go SchedulerSigHUPHandler()
-	go SchedulerService()
+	services.Go(SchedulerService)
 	ServicesRunning = true
 
 }
+func DoStartGateway() {
+	services.Go(GatewayService)
+	ServicesRunning = true
+}
 func DoHelp() {
 	fmt.Print("Webtools is an automation tool for use by developers to run commands remotely on content servers.\n" +
 		"\n" +
@@ -182,26 +490,120 @@ func DoHelp() {
 		"webtools command <required arguments> [optional arguments] \n" +
 		"\n" +
 		"The commands are:\n" +
+		"  audit [--app <Appid>] [--since <duration>] [--json]\n" +
+		"                            - Display the audit log of the agent or scheduler\n" +
+		"                              on this host, for App only and the last\n" +
+		"                              duration only, e.g. --since 1h\n" +
 		"  help                      - Display this text\n" +
-		"  kill <pid>                - Kill PID on content server\n" +
-		"  ping scheduler            - Display status of scheduler\n" +
-		"  ping agent <agent addr>   - Display status of agent at connect string\n" +
-		"  ps                        - Display processes on content server \n" +
+		"  keygen [file]             - Create a CURVE keypair, print it or save it to\n" +
+		"                              file and its public key to file.pub\n" +
+		"  kill [-<signal>] <pid>    - Send signal (default TERM) to PID on content\n" +
+		"                              server, e.g. kill -9 <pid>, kill -HUP <pid>\n" +
+		"                              or kill --signal=HUP <pid>\n" +
+		"  logs [-f] [-n <lines>] [file]\n" +
+		"                            - Display the last lines (default 10) of the App\n" +
+		"                              log files, or only file, -f follows them\n" +
+		"  ping scheduler            - Display status, protocol version and supported\n" +
+		"                              operations of scheduler\n" +
+		"  ping agent <agent addr>   - Display status, protocol version and supported\n" +
+		"                              operations of agent at connect string\n" +
+		"  ps [--json]               - Display processes on content server, --json\n" +
+		"                              prints the raw process records\n" +
 		"  scheduler lookup [Appid]  - Query scheduler for agent address of App\n" +
-		"  service <agent|scheduler> - Start agent or scheduler or both\n" +
+		"  scheduler list [glob] [--agent=<agent addr>] [--json]\n" +
+		"                            - List the Apps matching glob and their agents,\n" +
+		"                              and the agents with their last heartbeat or\n" +
+		"                              ping, --agent shows only that agent\n" +
+		"  scheduler set <Appid> <agent addr>[,<agent addr>...] [--tags=tag,...]\n" +
+		"                            - Map App to the agents at connect strings, the\n" +
+		"                              first is the primary, and replace its tags if\n" +
+		"                              --tags is given\n" +
+		"  scheduler import <file>   - Import a scheduler.json file into the scheduler\n" +
+		"                              DB, run on the scheduler host\n" +
+		"  scheduler unset <Appid>   - Remove App from the scheduler\n" +
+		"  service <agent|scheduler|gateway>\n" +
+		"                            - Start agent, scheduler or HTTP gateway, or\n" +
+		"                              several of them\n" +
 		"  start                     - Execute ~/bin/start on content server \n" +
 		"  stop                      - Execute ~/bin/stop on content server \n" +
+		"  restart                   - Execute ~/bin/restart on content server, or\n" +
+		"                              ~/bin/stop then ~/bin/start if there is none\n" +
+		"  status                    - Execute ~/bin/status, if any, on content server\n" +
+		"                              and report whether App processes are running\n" +
+		"  user add <user> <roles> <Appids>\n" +
+		"                            - Add user to the password DB, roles and Appids\n" +
+		"                              are comma separated, Appid * matches any App\n" +
+		"  user del <user>           - Remove user from the password DB\n" +
+		"  user passwd <user>        - Change the password of user in the password DB\n" +
 		"  version                   - Display the version of webtools CLI in use\n" +
 		"\n" +
+		"An App may run on several agents. start, stop, restart, status and ps run on\n" +
+		"all of them at once and report the result per agent, kill and logs run on\n" +
+		"a single agent and need --host when the App has more than one.\n" +
+		"--host=<host>[,<host>...] selects agents by connect string or host name,\n" +
+		"e.g. webtools restart --host=web2.\n" +
+		"\n" +
+		"Exit status: 0 on success, 1-63 the exit code of a failed command on the\n" +
+		"content server (63 if it was outside 1-63 or killed by a signal), 64 usage\n" +
+		"error, 65 other failure, 66 scheduler unreachable, 67 AppID not found,\n" +
+		"68 agent unreachable, 69 unauthorized, 70 command exceeded its execution\n" +
+		"timeout, 71 agent or scheduler too old for the operation.\n" +
+		"\n" +
 		"Environment variables that affect webtools operation, default is [value]:\n" +
 		"WT_DEBUG            - Set to true to enable debugging output [false]\n" +
 		"WT_SCHEDULERADDRESS - Connection string to Webtools scheduler [tcp://localhost:9912]\n" +
 		"WT_APPID            - Application identifier [current username]\n" +
 		"WT_SCHEDULERDBPATH  - Path to scheduler DB json file\n" +
 		"                      [/usr/local/etc/webtools/scheduler.json\n" +
+		"WT_SCHEDULERSTORE   - Scheduler DB format, json or bolt [json]\n" +
+		"WT_SCHEDULERWATCH   - Reload a json scheduler DB when its file changes,\n" +
+		"                      Linux only [true]\n" +
 		"WT_SCHEDULERLISTEN  - Listen string for 0MQ [tcp://*:9912]\n" +
 		"WT_AGENTLISTEN      - Listen string for 0MQ [tcp://*:9924]\n" +
 		"WT_AGENTTIMEOUT     - Wait how long for agent response [30]\n" +
+		"WT_AGENTWORKERS     - Number of requests an agent runs concurrently [8]\n" +
+		"WT_AGENTEXECTIMEOUT - Seconds an agent lets a command run before killing it [25]\n" +
+		"WT_AGENTEXECTIMEOUTS- Per operation overrides, e.g. start:120,stop:60 []\n" +
+		"WT_AGENTLOGFOLLOWMAX- Seconds an agent follows logs for logs -f [3600]\n" +
+		"WT_AGENTMAXFOLLOWERS- Number of logs -f an agent serves at once [16]\n" +
+		"WT_AGENTMAXQUEUED   - Requests an agent queues per AppID before refusing [8]\n" +
+		"WT_AGENTADVERTISE   - Connect string an agent registers with the scheduler\n" +
+		"                      [tcp://<hostname>:<WT_AGENTLISTEN port>]\n" +
+		"WT_AGENTHEARTBEAT   - Seconds between agent heartbeats to the scheduler [10]\n" +
+		"WT_CURVE            - Set to true to encrypt and authenticate all 0MQ\n" +
+		"                      traffic with CURVE [false]\n" +
+		"WT_CURVESERVERKEY   - Keypair of this scheduler or agent\n" +
+		"                      [/usr/local/etc/webtools/server.key]\n" +
+		"WT_CURVESERVERKEYS  - Public keys clients expect of each scheduler and agent,\n" +
+		"                      by connect string or host [/usr/local/etc/webtools/server_keys]\n" +
+		"WT_CURVESERVERPUBLICKEY\n" +
+		"                    - Public key clients expect of servers not in\n" +
+		"                      WT_CURVESERVERKEYS [/usr/local/etc/webtools/server.key.pub]\n" +
+		"WT_CURVECLIENTKEY   - Keypair of the CLI [~/.webtools/client.key]\n" +
+		"WT_CURVEAUTHORIZEDKEYS\n" +
+		"                    - Client public keys the scheduler and agents accept\n" +
+		"                      [/usr/local/etc/webtools/authorized_keys]\n" +
+		"WT_GATEWAYLISTEN    - Address the HTTP gateway listens on [127.0.0.1:9980]\n" +
+		"WT_GATEWAYCERT      - TLS certificate file of the HTTP gateway, with\n" +
+		"WT_GATEWAYKEY         its key file, serves plain HTTP if unset\n" +
+		"WT_GATEWAYINSECURE  - Allow plain HTTP on a non-loopback address [false]\n" +
+		"WT_AUDITLOGPATH     - Audit log of the agent and scheduler, empty disables it\n" +
+		"                      [/var/log/webtools/audit.log]\n" +
+		"WT_AUDITMAXSIZE     - Megabytes the audit log grows to before it is rotated [100]\n" +
+		"WT_AUDITKEEP        - Number of rotated audit logs kept [5]\n" +
+		"WT_AUDITPINGS       - Also audit successful pings and heartbeats [false]\n" +
+		"WT_METRICSLISTEN    - Address the agent and scheduler serve Prometheus\n" +
+		"                      metrics on at /metrics, e.g. :9990, off if unset []\n" +
+		"WT_SHUTDOWNGRACE    - Seconds services let running commands finish on\n" +
+		"                      SIGINT or SIGTERM before killing them [30]\n" +
+		"WT_PASSWORDDBPATH   - Path to password DB json file\n" +
+		"                      [/usr/local/etc/webtools/passwords.json]\n" +
+		"WT_USER             - User name sent to scheduler and agent [current username]\n" +
+		"WT_PASSWORD         - Password sent to scheduler and agent, prompted if unset\n" +
+		"\n" +
+		"Roles are admin (all operations), developer (start, stop, restart, status,\n" +
+		"logs, ps, kill, lookup), readonly (status, logs, ps, lookup) and agent\n" +
+		"(register, for the WT_USER of agents, which also needs Appid *).\n" +
 		"\n")
 }
 
@@ -209,11 +611,12 @@ func DoPingAgent(host string) {
 	if config.Debug {
 		log.Println("DoPingAgent(", host, ")")
 	}
-	ok, err := AgentPing(host)
-	if ok {
-		fmt.Println("Agent is alive.")
+	caps, err := cliClient().Agent(host).Ping(context.Background())
+	if err == nil {
+		fmt.Printf("Agent is alive, protocol %d, supports: %s\n", caps.Proto, strings.Join(caps.Caps, ", "))
 	} else {
 		fmt.Println("Agent is not responding. [", err.Error(), "]")
+		ExitStatus = exitCode(err)
 	}
 }
 
@@ -221,56 +624,143 @@ func DoPingSched() {
 	if config.Debug {
 		log.Println("DoPingSched()")
 	}
-	ok, err := SchedulerPing()
-	if ok {
-		fmt.Println("Scheduler is alive.")
+	caps, err := cliClient().PingScheduler(context.Background())
+	if err == nil {
+		fmt.Printf("Scheduler is alive, protocol %d, supports: %s\n", caps.Proto, strings.Join(caps.Caps, ", "))
+		if db := caps.SchedulerDB; db != nil {
+			fmt.Printf("Scheduler DB has %d Apps, loaded %s\n", db.Apps, db.Loaded.Local().Format(time.RFC1123))
+			if db.ReloadError != "" {
+				fmt.Printf("Reload at %s failed, the DB loaded before is in service: %s\n",
+					db.ReloadFailed.Local().Format(time.RFC1123), db.ReloadError)
+				ExitStatus = ExitFailure
+			}
+		}
 	} else {
 		fmt.Println("Scheduler is not responding. [", err.Error(), "]")
+		ExitStatus = exitCode(err)
 	}
 }
 
-func DoKill(pid int) {
+func DoKill(pid int, signal string) {
 	if config.Debug {
-		log.Println("DoKill(", pid, ")")
+		log.Println("DoKill(", pid, ",", signal, ")")
+	}
+	agent, err := agentTarget(config.AppId)
+	if err != nil {
+		fmt.Println("kill failed.")
+		fmt.Println(err)
+		ExitStatus = exitCode(err)
+		return
 	}
-	output, err := AgentReqKill(config.AppId, pid)
+	output, err := cliClient().Agent(agent).Kill(context.Background(), config.AppId, pid, signal)
 	if err != nil {
 		fmt.Println("kill failed.")
 		fmt.Println(output)
 		fmt.Println(err)
+		ExitStatus = exitCode(err)
 		return
 	}
 	fmt.Println(output)
 }
 
-func DoPs() {
+func DoPs(jsonOut bool) {
 	if config.Debug {
-		log.Println("DoPs()")
+		log.Println("DoPs(", jsonOut, ")")
+	}
+	if jsonOut {
+		doPsJSON()
+		return
 	}
-	output, err := AgentReqPs(config.AppId)
+	fanOut(func(agent string, out io.Writer, sink OutputSink) error {
+		procs, err := cliClient().Agent(agent).Ps(context.Background(), config.AppId)
+		if plain, ok := err.(*client.PlainPsError); ok {
+			fmt.Fprintln(out, plain.Output)
+			return nil
+		}
+		if err != nil {
+			fmt.Fprintln(out, "ps failed.")
+			fmt.Fprintln(out, err)
+			return err
+		}
+		printProcs(out, procs)
+		return nil
+	})
+}
+
+// doPsJSON prints the raw process records. With more than one agent they are printed as one
+// JSON object keyed by agent connect string.
+func doPsJSON() {
+	agents, err := agentTargets(config.AppId)
 	if err != nil {
 		fmt.Println("ps failed.")
-		fmt.Println(output)
 		fmt.Println(err)
+		ExitStatus = exitCode(err)
 		return
 	}
-	fmt.Println(output)
+	results := cliClient().EachAgent(agents, func(i int, a *client.Agent) (string, error) {
+		procs, err := a.Ps(context.Background(), config.AppId)
+		if plain, ok := err.(*client.PlainPsError); ok {
+			b, _ := json.Marshal(plain.Output)
+			return string(b), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		b, _ := json.Marshal(procs)
+		return string(b), nil
+	})
+	all := make(map[string]json.RawMessage)
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(os.Stderr, "ps failed on %s: %s\n", r.Agent, r.Err)
+			if ExitStatus == ExitOK {
+				ExitStatus = exitCode(r.Err)
+			}
+			continue
+		}
+		if len(agents) == 1 {
+			fmt.Println(r.Output)
+			return
+		}
+		all[r.Agent] = json.RawMessage(r.Output)
+	}
+	if len(agents) > 1 {
+		b, _ := json.MarshalIndent(all, "", "  ")
+		fmt.Println(string(b))
+	}
+}
 
+// printProcs renders procs as a table in the style of ps.
+func printProcs(out io.Writer, procs []ProcInfo) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tPPID\tSTAT\tRSS(KB)\tTIME\tSTART\tCOMMAND")
+	for _, p := range procs {
+		cpu := time.Duration(p.CPUSeconds) * time.Second
+		start := p.StartTime.Format("Jan02")
+		if time.Since(p.StartTime) < 24*time.Hour {
+			start = p.StartTime.Format("15:04")
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%d:%02d:%02d\t%s\t%s\n", p.Pid, p.PPid, p.State, p.RSS/1024,
+			int(cpu.Hours()), int(cpu.Minutes())%60, int(cpu.Seconds())%60, start, p.Cmdline)
+	}
+	w.Flush()
 }
 
 func DoStart() {
 	if config.Debug {
 		log.Println("DoStart()")
 	}
-	output, err := AgentReqStartApp(config.AppId)
-	if err != nil {
-		fmt.Println("App start failed.")
-		fmt.Println(output)
-		fmt.Println(err)
-		return
-	}
-	fmt.Println("App start ok.")
-	fmt.Println(output)
+	fanOut(func(agent string, out io.Writer, sink OutputSink) error {
+		//Output is streamed to sink, agents that cannot stream return it all at the end.
+		output, err := cliClient().Agent(agent).Start(context.Background(), config.AppId, sink)
+		fmt.Fprint(out, output)
+		if err != nil {
+			fmt.Fprintln(out, "App start failed:", err)
+			return err
+		}
+		fmt.Fprintln(out, "App start ok.")
+		return nil
+	})
 
 }
 
@@ -278,16 +768,215 @@ func DoStop() {
 	if config.Debug {
 		log.Println("DoStop()")
 	}
-	output, err := AgentReqStopApp(config.AppId)
+	fanOut(func(agent string, out io.Writer, sink OutputSink) error {
+		//Output is streamed to sink, agents that cannot stream return it all at the end.
+		output, err := cliClient().Agent(agent).Stop(context.Background(), config.AppId, sink)
+		fmt.Fprint(out, output)
+		if err != nil {
+			fmt.Fprintln(out, "App stop failed:", err)
+			return err
+		}
+		fmt.Fprintln(out, "App stop ok.")
+		return nil
+	})
+
+}
+
+func DoRestart() {
+	if config.Debug {
+		log.Println("DoRestart()")
+	}
+	fanOut(func(agent string, out io.Writer, sink OutputSink) error {
+		//Output is streamed to sink, agents that cannot stream return it all at the end.
+		output, err := cliClient().Agent(agent).Restart(context.Background(), config.AppId, sink)
+		fmt.Fprint(out, output)
+		if err != nil {
+			fmt.Fprintln(out, "App restart failed:", err)
+			return err
+		}
+		fmt.Fprintln(out, "App restart ok.")
+		return nil
+	})
+
+}
+
+func DoStatus() {
+	if config.Debug {
+		log.Println("DoStatus()")
+	}
+	fanOut(func(agent string, out io.Writer, sink OutputSink) error {
+		status, err := cliClient().Agent(agent).Status(context.Background(), config.AppId)
+		if err != nil {
+			fmt.Fprintln(out, "App status failed.")
+			fmt.Fprintln(out, err)
+			return err
+		}
+		if status.HasStatusScript {
+			fmt.Fprintf(out, "~/bin/status exited with code %d\n", status.ExitCode)
+			fmt.Fprint(out, status.Output)
+		} else {
+			fmt.Fprintln(out, "No ~/bin/status script.")
+		}
+		if status.Running {
+			fmt.Fprintf(out, "App is running, %d processes.\n", status.Processes)
+		} else {
+			fmt.Fprintln(out, "App is not running, no processes.")
+		}
+		return nil
+	})
+
+}
+
+func DoLogs(args LogArgs) {
+	if config.Debug {
+		log.Println("DoLogs(", args, ")")
+	}
+	agent, err := agentTarget(config.AppId)
 	if err != nil {
-		fmt.Println("App stop failed.")
-		fmt.Println(output)
-		fmt.Println(err)
+		fmt.Println("App logs failed:", err)
+		ExitStatus = exitCode(err)
 		return
 	}
-	fmt.Println("App stop ok.")
-	fmt.Println(output)
+	output, err := cliClient().Agent(agent).Logs(context.Background(), config.AppId, args, printOutput)
+	fmt.Print(output)
+	if err != nil {
+		fmt.Println("App logs failed:", err)
+		ExitStatus = exitCode(err)
+	}
+
+}
+
+// agentTargets returns the agents of appid selected by cliHosts, or all of them.
+func agentTargets(appid string) ([]AgentState, error) {
+	agents, err := cliClient().Agents(context.Background(), appid)
+	if err != nil || len(cliHosts) == 0 {
+		return agents, err
+	}
+	selected := selectAgents(agents, cliHosts)
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no agent of AppID %s matches --host=%s", appid, strings.Join(cliHosts, ","))
+	}
+	return selected, nil
+}
+
+// selectAgents returns the agents matching one of hosts by connect string or host name.
+func selectAgents(agents []AgentState, hosts []string) []AgentState {
+	var selected []AgentState
+	for _, a := range agents {
+		for _, host := range hosts {
+			if a.Address == host || client.EndpointHost(a.Address) == host {
+				selected = append(selected, a)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// usageError is an error in the command line found only once the scheduler was asked, it exits
+// with ExitUsage.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// agentTarget returns the single agent a command that cannot fan out runs on. If appid has more
+// than one agent cliHosts must select one, so a kill or logs never goes to whichever agent
+// happens to be preferred.
+func agentTarget(appid string) (string, error) {
+	agents, err := agentTargets(appid)
+	if err != nil {
+		return "", err
+	}
+	if len(agents) > 1 {
+		if len(cliHosts) > 0 {
+			return "", usageError(fmt.Sprintf("--host=%s matches %d agents, select one", strings.Join(cliHosts, ","), len(agents)))
+		}
+		return "", usageError(fmt.Sprintf("AppID %s has %d agents, select one with --host=<host>", appid, len(agents)))
+	}
+	preferred, ok := PreferredAgent(agents)
+	if !ok {
+		return "", ErrAgentDead
+	}
+	return preferred.Address, nil
+}
+
+// fanOut runs fn on every agent of config.AppId selected by agentTargets, all at once. fn writes
+// its output to out and passes sink to requests that stream command output. With one agent out
+// is stdout and output is streamed as it arrives. With more than one the output of each agent is
+// buffered and printed under a header once every agent is done, so it stays together, followed by
+// a result per agent. Agents the scheduler marked dead are skipped. ExitStatus is set from the
+// first failure in agent order.
+func fanOut(fn func(agent string, out io.Writer, sink OutputSink) error) {
+	agents, err := agentTargets(config.AppId)
+	if err != nil {
+		fmt.Println("Scheduler lookup failed:", err)
+		ExitStatus = exitCode(err)
+		return
+	}
+	outputs := make([]*lockedBuffer, len(agents))
+	for i := range outputs {
+		outputs[i] = &lockedBuffer{}
+	}
+	results := cliClient().EachAgent(agents, func(i int, a *client.Agent) (string, error) {
+		if len(agents) == 1 {
+			return "", fn(a.Address, os.Stdout, printOutput)
+		}
+		return "", fn(a.Address, outputs[i], func(fd int, p []byte) { outputs[i].Write(p) })
+	})
+	for i, r := range results {
+		if agents[i].Status == AgentDead {
+			fmt.Fprintln(outputs[i], ErrAgentDead)
+		}
+		if len(agents) > 1 {
+			fmt.Printf("==> %s <==\n", r.Agent)
+		}
+		fmt.Print(outputs[i].String())
+		if r.Err != nil && ExitStatus == ExitOK {
+			ExitStatus = exitCode(r.Err)
+		}
+	}
+	if len(agents) < 2 {
+		return
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(w, "%s\tfailed: %s\n", r.Agent, r.Err)
+		} else {
+			fmt.Fprintf(w, "%s\tok\n", r.Agent)
+		}
+	}
+	w.Flush()
+}
+
+var cliClientOnce sync.Once
+var cliClientValue *client.Client
 
+// cliClient returns the client.Client the CLI sends its requests with, see newClient. The user
+// is prompted for a password on the first request that needs one, see cliCredentials. Exits if
+// the client cannot be set up, e.g. for a missing CURVE key.
+func cliClient() *client.Client {
+	cliClientOnce.Do(func() {
+		c, err := newClient(cliCredentials)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(ExitFailure)
+		}
+		cliClientValue = c
+	})
+	return cliClientValue
+}
+
+// printOutput is the OutputSink for commands streamed from the agent.
+func printOutput(fd int, p []byte) {
+	if fd == 2 {
+		os.Stderr.Write(p)
+	} else {
+		os.Stdout.Write(p)
+	}
 }
 
 func DoSchedLookup(appid string) {
@@ -295,11 +984,264 @@ func DoSchedLookup(appid string) {
 		log.Println("DoSchedLookup()")
 	}
 
-	addr, err := SchedulerReqLookup(appid)
+	agents, err := cliClient().Agents(context.Background(), appid)
 	if err != nil {
 		fmt.Printf("Scheduler lookup failed for AppID = %s: %s\n", appid, err.Error())
+		ExitStatus = exitCode(err)
+		return
+	}
+	preferred, ok := PreferredAgent(agents)
+	for i, a := range agents {
+		role := "primary"
+		if i > 0 {
+			role = "secondary"
+		}
+		if ok && a.Address == preferred.Address {
+			role += ", preferred"
+		}
+		switch {
+		case a.Status == AgentDead:
+			fmt.Printf("The agent for AppID=%s is at %s (%s), it is dead (missed its heartbeats)\n", appid, a.Address, role)
+		case a.Status != "":
+			fmt.Printf("The agent for AppID=%s is at %s (%s), it is %s\n", appid, a.Address, role, a.Status)
+		default:
+			fmt.Printf("The agent for AppID=%s is at %s (%s)\n", appid, a.Address, role)
+		}
+	}
+	if !ok {
+		ExitStatus = exitCode(ErrAgentDead)
+	}
+
+}
+
+func DoSchedList(pattern string, agent string, jsonOut bool) {
+	if config.Debug {
+		log.Println("DoSchedList(", pattern, ",", agent, ")")
+	}
+	apps, agents, err := cliClient().List(context.Background(), pattern, agent)
+	if err != nil {
+		fmt.Println("Scheduler list failed:", err)
+		ExitStatus = exitCode(err)
+		return
+	}
+	if jsonOut {
+		b, _ := json.MarshalIndent(struct {
+			Apps   []SchedEntry
+			Agents []AgentInfo
+		}{apps, agents}, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "APPID\tAGENT\tSTATUS\tOTHER AGENTS\tOWNER\tTAGS")
+	for _, app := range apps {
+		var others []string
+		for _, a := range app.Agents {
+			if a.Address != app.Address {
+				others = append(others, fmt.Sprintf("%s(%s)", a.Address, dashIfEmpty(a.Status)))
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", app.AppID, app.Address, dashIfEmpty(app.Status),
+			dashIfEmpty(strings.Join(others, ",")), dashIfEmpty(app.Owner), dashIfEmpty(strings.Join(app.Tags, ",")))
+	}
+	w.Flush()
+	fmt.Println()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "AGENT\tHOSTNAME\tVERSION\tAPPS\tSTATUS\tLAST SEEN\tLAST ERROR")
+	for _, a := range agents {
+		seen := "-"
+		if !a.LastSeen.IsZero() {
+			seen = time.Since(a.LastSeen).Truncate(time.Second).String() + " ago"
+		}
+		if !a.Registered {
+			a.Hostname = "(scheduler DB)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", a.Address, dashIfEmpty(a.Hostname), dashIfEmpty(a.Version),
+			len(a.AppIDs), dashIfEmpty(a.Status), seen, dashIfEmpty(a.LastError))
+	}
+	w.Flush()
+
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func DoSchedSet(appid string, agents []string, tags []string) {
+	if config.Debug {
+		log.Println("DoSchedSet(", appid, ",", agents, ",", tags, ")")
+	}
+
+	if err := cliClient().Set(context.Background(), appid, agents, tags); err != nil {
+		fmt.Printf("Scheduler set failed for AppID = %s: %s\n", appid, err.Error())
+		ExitStatus = exitCode(err)
+	} else if len(agents) == 1 {
+		fmt.Printf("The agent for AppID=%s is now %s\n", appid, agents[0])
 	} else {
-		fmt.Printf("The agent for AppID=%s is at %s\n", appid, addr)
+		fmt.Printf("The agents for AppID=%s are now %s, %s is the primary\n", appid, strings.Join(agents, ", "), agents[0])
+	}
+}
+
+func DoSchedImport(path string) {
+	if config.Debug {
+		log.Println("DoSchedImport(", path, ")")
+	}
+	store, err := OpenSchedulerStore(config.SchedulerStore, config.SchedulerDbPath)
+	if err != nil {
+		fmt.Println("Scheduler import failed:", err)
+		ExitStatus = ExitFailure
+		return
+	}
+	defer store.Close()
+
+	n, err := ImportSchedulerDB(store, path)
+	if err != nil {
+		fmt.Println("Scheduler import failed:", err)
+		ExitStatus = ExitFailure
+		return
+	}
+	fmt.Printf("Imported %d AppIDs from %s into the %s store %s\n", n, path, config.SchedulerStore, config.SchedulerDbPath)
+}
+
+func DoSchedUnset(appid string) {
+	if config.Debug {
+		log.Println("DoSchedUnset(", appid, ")")
+	}
+
+	if err := cliClient().Unset(context.Background(), appid); err != nil {
+		fmt.Printf("Scheduler unset failed for AppID = %s: %s\n", appid, err.Error())
+		ExitStatus = exitCode(err)
+	} else {
+		fmt.Printf("AppID=%s removed from scheduler\n", appid)
+	}
+}
+
+func DoUserAdd(user string, roles []string, appids []string) {
+	if config.Debug {
+		log.Println("DoUserAdd(", user, ",", roles, ",", appids, ")")
+	}
+	password, err := readNewPassword(user)
+	if err != nil {
+		fmt.Println("User add failed:", err)
+		ExitStatus = ExitFailure
+		return
+	}
+	if err := UserAdd(config.PasswordDbPath, user, password, roles, appids); err != nil {
+		fmt.Println("User add failed:", err)
+		ExitStatus = ExitFailure
+		return
+	}
+	fmt.Printf("User %s added to %s\n", user, config.PasswordDbPath)
+}
+
+func DoUserDel(user string) {
+	if config.Debug {
+		log.Println("DoUserDel(", user, ")")
+	}
+	if err := UserDel(config.PasswordDbPath, user); err != nil {
+		fmt.Println("User del failed:", err)
+		ExitStatus = ExitFailure
+		return
+	}
+	fmt.Printf("User %s removed from %s\n", user, config.PasswordDbPath)
+}
+
+func DoUserPasswd(user string) {
+	if config.Debug {
+		log.Println("DoUserPasswd(", user, ")")
+	}
+	password, err := readNewPassword(user)
+	if err != nil {
+		fmt.Println("User passwd failed:", err)
+		ExitStatus = ExitFailure
+		return
+	}
+	if err := UserPasswd(config.PasswordDbPath, user, password); err != nil {
+		fmt.Println("User passwd failed:", err)
+		ExitStatus = ExitFailure
+		return
+	}
+	fmt.Printf("Password for %s changed in %s\n", user, config.PasswordDbPath)
+}
+
+// readNewPassword prompts twice for a new password for user and checks both entries match.
+func readNewPassword(user string) (string, error) {
+	password, err := ReadPassword(fmt.Sprintf("New password for %s: ", user))
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		again, err := ReadPassword("Retype new password: ")
+		if err != nil {
+			return "", err
+		}
+		if again != password {
+			return "", errors.New("passwords do not match")
+		}
+	}
+	return password, nil
+}
+
+func DoKeygen(path string) {
+	if config.Debug {
+		log.Println("DoKeygen(", path, ")")
+	}
+	var kp CurveKeypair
+	var err error
+	if path == "" {
+		kp, err = NewCurveKeypair()
+	} else {
+		kp, err = GenerateKeyFile(path)
+	}
+	if err != nil {
+		fmt.Println("keygen failed:", err)
+		ExitStatus = ExitFailure
+		return
+	}
+	if path == "" {
+		fmt.Println("public=" + kp.Public)
+		fmt.Println("secret=" + kp.Secret)
+		return
+	}
+	fmt.Printf("Wrote keypair to %s and the public key to %s.pub\n", path, path)
+	fmt.Println("public=" + kp.Public)
+
+}
+
+func DoAudit(appid string, since time.Time, jsonOut bool) {
+	if config.Debug {
+		log.Println("DoAudit(", appid, ",", since, ")")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if !jsonOut {
+		fmt.Fprintln(w, "TIME\tSERVICE\tUSER\tPEER\tAPPID\tOP\tARGS\tSTATUS\tEXIT\tSECONDS")
+	}
+	err := ReadAudit(appid, since, func(rec *AuditRecord) {
+		if jsonOut {
+			b, _ := json.Marshal(rec)
+			fmt.Println(string(b))
+			return
+		}
+		exit := "-"
+		if rec.ExitCode != 0 {
+			exit = strconv.Itoa(rec.ExitCode)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.3f\n", rec.Time.Local().Format("2006-01-02 15:04:05"),
+			rec.Service, dashIfEmpty(rec.User), dashIfEmpty(rec.Peer), dashIfEmpty(rec.AppID), rec.Op,
+			dashIfEmpty(rec.Args), rec.Status, exit, rec.Seconds)
+	})
+	w.Flush()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Audit log:", err)
+		ExitStatus = ExitFailure
 	}
 
 }
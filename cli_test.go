@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/ictusa/webtools/client"
+	"os"
+	"testing"
+)
+
+//exitPanic is what osExit panics with in the tests, so parsing stops where webtools would exit.
+type exitPanic int
+
+//parseExit runs ParseCli on args and returns the exit status webtools would exit with.
+func parseExit(args []string) (status int) {
+	ExitStatus, cliHosts = ExitOK, nil
+	osExit = func(code int) { panic(exitPanic(code)) }
+	defer func() { osExit = os.Exit }()
+	defer func() {
+		if r := recover(); r != nil {
+			code, ok := r.(exitPanic)
+			if !ok {
+				panic(r)
+			}
+			status = int(code)
+		}
+	}()
+	ParseCli(args)
+	return ExitStatus
+}
+
+//TestParseCliUsage checks that command lines webtools cannot run exit with ExitUsage before any
+//request is sent, rather than panicking or exiting 0.
+func TestParseCliUsage(t *testing.T) {
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{}, ExitOK},
+		{[]string{"help"}, ExitOK},
+		{[]string{"--host=web1"}, ExitOK},
+		{[]string{"frob"}, ExitUsage},
+		{[]string{"ping"}, ExitUsage},
+		{[]string{"ping", "foo"}, ExitUsage},
+		{[]string{"ping", "agent"}, ExitUsage},
+		{[]string{"ping", "agent", "web1", "web2"}, ExitUsage},
+		{[]string{"ping", "scheduler", "extra"}, ExitUsage},
+		{[]string{"kill"}, ExitUsage},
+		{[]string{"kill", "abc"}, ExitUsage},
+		{[]string{"kill", "-FOO", "12"}, ExitUsage},
+		{[]string{"kill", "--signal=TERM", "12", "13"}, ExitUsage},
+		{[]string{"scheduler"}, ExitUsage},
+		{[]string{"scheduler", "frob"}, ExitUsage},
+		{[]string{"scheduler", "set", "app"}, ExitUsage},
+		{[]string{"scheduler", "unset"}, ExitUsage},
+		{[]string{"scheduler", "import"}, ExitUsage},
+		{[]string{"scheduler", "list", "--bogus"}, ExitUsage},
+		{[]string{"service"}, ExitUsage},
+		{[]string{"service", "frob"}, ExitUsage},
+		{[]string{"user"}, ExitUsage},
+		{[]string{"user", "add", "u"}, ExitUsage},
+		{[]string{"user", "del"}, ExitUsage},
+		{[]string{"ps", "--bogus"}, ExitUsage},
+		{[]string{"keygen", "a", "b"}, ExitUsage},
+		{[]string{"logs", "-n", "x"}, ExitUsage},
+		{[]string{"logs", "-x"}, ExitUsage},
+		{[]string{"logs", "a", "b"}, ExitUsage},
+		{[]string{"audit", "--since", "x"}, ExitUsage},
+		{[]string{"audit", "--bogus", "x"}, ExitUsage},
+		{[]string{"audit", "--app"}, ExitUsage},
+	}
+	for _, test := range tests {
+		if got := parseExit(test.args); got != test.want {
+			t.Errorf("webtools %q exits with %d, want %d", test.args, got, test.want)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, ExitOK},
+		{ErrSchedulerTimeout, ExitSchedulerUnreachable},
+		{ErrAppNotFound, ExitAppNotFound},
+		{ErrAgentTimeout, ExitAgentTimeout},
+		{ErrAgentDead, ExitAgentTimeout},
+		{ErrUnauthorized, ExitUnauthorized},
+		{ErrForbidden, ExitUnauthorized},
+		{ErrExecTimeout, ExitExecTimeout},
+		{ErrAgentUnsupported, ExitUnsupported},
+		{ErrSchedulerUnsupported, ExitUnsupported},
+		{&TooOldError{Server: "agent", Cap: client.CapSignal}, ExitUnsupported},
+		{usageError("AppID app has 2 agents"), ExitUsage},
+		{&CommandError{ExitCode: 1}, 1},
+		{&CommandError{ExitCode: 2}, 2},
+		{&CommandError{ExitCode: 62}, 62},
+		{&CommandError{ExitCode: 63}, ExitCommandFailed},
+		{&CommandError{ExitCode: 64}, ExitCommandFailed},
+		{&CommandError{ExitCode: 255}, ExitCommandFailed},
+		{&CommandError{ExitCode: -1}, ExitCommandFailed},
+		{os.ErrNotExist, ExitFailure},
+	}
+	for _, test := range tests {
+		if got := exitCode(test.err); got != test.want {
+			t.Errorf("exitCode(%v) = %d, want %d", test.err, got, test.want)
+		}
+	}
+}
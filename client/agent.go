@@ -0,0 +1,194 @@
+//
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	zmq "github.com/pebbe/zmq4"
+)
+
+//Agent sends requests to the agent at Address, see Client.Agent.
+type Agent struct {
+	c       *Client
+	Address string
+}
+
+//Start runs ~/bin/start of appID and returns its output. If sink is not nil the output is passed
+//to it as the agent streams it instead of being returned, agents that cannot stream return it all
+//at the end. The output is streamed from the agent even if sink is nil, so Options.AgentTimeout
+//is the longest gap between keepalives rather than a limit on how long the command runs. A
+//CommandError holds the exit code of a start that failed.
+func (a *Agent) Start(ctx context.Context, appID string, sink OutputSink) (string, error) {
+	return a.command(ctx, &AgentMsg{MsgType: MsgAgentStartApp, AppID: appID}, CapStart, sink)
+}
+
+//Stop runs ~/bin/stop of appID, see Start.
+func (a *Agent) Stop(ctx context.Context, appID string, sink OutputSink) (string, error) {
+	return a.command(ctx, &AgentMsg{MsgType: MsgAgentStopApp, AppID: appID}, CapStop, sink)
+}
+
+//Restart runs ~/bin/restart of appID, or ~/bin/stop and ~/bin/start if it has none, see Start.
+func (a *Agent) Restart(ctx context.Context, appID string, sink OutputSink) (string, error) {
+	return a.command(ctx, &AgentMsg{MsgType: MsgAgentRestartApp, AppID: appID}, CapRestart, sink)
+}
+
+//Logs tails the log files of appID, see LogArgs. Output is passed to sink as the agent streams
+//it, a follow runs until ctx is done or the agent ends it.
+func (a *Agent) Logs(ctx context.Context, appID string, args LogArgs, sink OutputSink) (string, error) {
+	data, _ := json.Marshal(args)
+	return a.run(ctx, &AgentMsg{MsgType: MsgAgentLogs, AppID: appID, MsgData: string(data)}, CapLogs, sink)
+}
+
+//Status runs ~/bin/status of appID, if it has one, and counts its processes.
+func (a *Agent) Status(ctx context.Context, appID string) (*AppStatus, error) {
+	data, err := a.run(ctx, &AgentMsg{MsgType: MsgAgentStatusApp, AppID: appID}, CapStatus, nil)
+	if err != nil {
+		return nil, err
+	}
+	var status AppStatus
+	if err := json.Unmarshal([]byte(data), &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+//Ps returns the processes of appID. Agents speaking protocol version 1 reply with plain ps
+//output, which is returned in a PlainPsError.
+func (a *Agent) Ps(ctx context.Context, appID string) ([]ProcInfo, error) {
+	data, err := a.run(ctx, &AgentMsg{MsgType: MsgAgentPs, AppID: appID}, CapPs, nil)
+	if err != nil {
+		return nil, err
+	}
+	var procs []ProcInfo
+	if json.Unmarshal([]byte(data), &procs) != nil {
+		return nil, &PlainPsError{data}
+	}
+	return procs, nil
+}
+
+//Kill sends the named signal, without the SIG prefix, to process pid of appID. SIGTERM is sent as
+//a bare PID, which agents that predate KillArgs understand, and SIGKILL as a MsgAgentForceKillPid.
+//Agents speaking protocol version 1 only send SIGTERM and get a TooOldError for any other signal.
+func (a *Agent) Kill(ctx context.Context, appID string, pid int, signal string) (string, error) {
+	req := AgentMsg{MsgType: MsgAgentKillPid, AppID: appID, MsgData: fmt.Sprintf("%d", pid)}
+	want := CapKill
+	switch {
+	case signal == "KILL":
+		req.MsgType = MsgAgentForceKillPid
+		want = CapSignal
+	case signal != "TERM":
+		args, _ := json.Marshal(KillArgs{pid, signal})
+		req.MsgData = string(args)
+		want = CapSignal
+	}
+	return a.run(ctx, &req, want, nil)
+}
+
+//Ping checks the agent is alive and returns its Capabilities.
+func (a *Agent) Ping(ctx context.Context) (Capabilities, error) {
+	reply, err := a.c.agentReq(ctx, a.Address, &AgentMsg{MsgType: MsgAgentPing}, nil)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	if reply.MsgType != MsgAgentPingReply {
+		return Capabilities{}, agentReplyError(reply)
+	}
+	if reply.Proto == 0 {
+		return Capabilities{Proto: 1, Caps: agentCapsV1}, nil
+	}
+	return Capabilities{Proto: reply.Proto, Caps: reply.Caps}, nil
+}
+
+//run sends req, which needs capability want, and returns the MsgData of the reply. A reply of
+//another MsgType is converted to an error, the MsgData is still returned with it since it holds
+//the output of a failed command.
+func (a *Agent) run(ctx context.Context, req *AgentMsg, want string, sink OutputSink) (string, error) {
+	msgType := req.MsgType
+	reply, err := a.c.agentReq(ctx, a.Address, req, sink)
+	if err != nil {
+		return "", err
+	}
+	if err := agentTooOld(reply, want); err != nil {
+		return "", err
+	}
+	if reply.MsgType != msgType {
+		return reply.MsgData, agentReplyError(reply)
+	}
+	return reply.MsgData, nil
+}
+
+//command runs a start, stop or restart, see Start. Without a sink the streamed output is
+//collected and returned, ahead of any output the agent returns at the end.
+func (a *Agent) command(ctx context.Context, req *AgentMsg, want string, sink OutputSink) (string, error) {
+	if sink != nil {
+		return a.run(ctx, req, want, sink)
+	}
+	var streamed bytes.Buffer
+	output, err := a.run(ctx, req, want, func(fd int, p []byte) { streamed.Write(p) })
+	return streamed.String() + output, err
+}
+
+//agentReq sends req to the agent at address and returns the reply. Credentials are added to every
+//request except MsgAgentPing. If sink is not nil the request is sent with Stream set and output is
+//passed to sink as the agent sends it. A DEALER socket is used so the agent can send several
+//messages in reply, Options.AgentTimeout then applies to the gap between messages.
+func (c *Client) agentReq(ctx context.Context, address string, req *AgentMsg, sink OutputSink) (*AgentMsg, error) {
+	c.debugf("agentReq(%d) to %s\n", req.MsgType, address)
+	if req.MsgType != MsgAgentPing {
+		req.User, req.Password = c.credentials()
+	}
+	req.Proto = ProtocolVersion
+	req.Stream = sink != nil
+
+	kind := zmq.REQ
+	if req.Stream {
+		kind = zmq.DEALER
+	}
+	requester, err := c.connect(kind, address)
+	if err != nil {
+		return nil, err
+	}
+	defer requester.Close()
+
+	jsonOut, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Stream {
+		//The empty delimiter frame makes the request look like it came from a REQ socket.
+		_, err = requester.SendMessage("", jsonOut)
+	} else {
+		_, err = requester.SendBytes(jsonOut, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		ok, err := wait(ctx, requester, c.opts.AgentTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			c.debugf("agentReq() timeout\n")
+			return nil, ErrAgentTimeout
+		}
+		frames, err := requester.RecvMessageBytes(0)
+		if err != nil {
+			return nil, err
+		}
+		var reply AgentMsg
+		if err := json.Unmarshal(frames[len(frames)-1], &reply); err != nil {
+			return nil, err
+		}
+		if reply.MsgType != MsgAgentOutput {
+			c.debugf("agentReq() Recv msg: %s\n", reply)
+			return &reply, nil
+		}
+		if reply.Fd != 0 && sink != nil {
+			sink(reply.Fd, []byte(reply.MsgData))
+		}
+	}
+}
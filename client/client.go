@@ -0,0 +1,479 @@
+//Package client talks to the webtools scheduler and agents over 0MQ. It defines the messages of
+//their protocol, which the servers share, and a Client that sends them with explicit options, so
+//programs can manage apps without running the webtools CLI.
+//
+//	c := client.New(client.Options{SchedulerAddress: "tcp://sched:9912", User: "deploy", Password: pw})
+//	output, err := c.Restart(ctx, "myapp")
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	zmq "github.com/pebbe/zmq4"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DefaultSchedulerTimeout and DefaultAgentTimeout are used for Options left zero.
+const (
+	DefaultSchedulerTimeout = time.Second
+	DefaultAgentTimeout     = 30 * time.Second
+)
+
+//pollInterval is how often a request waiting for a reply checks whether its context is done.
+const pollInterval = 100 * time.Millisecond
+
+//Options configure a Client.
+type Options struct {
+	//SchedulerAddress is the 0MQ connect string of the scheduler, e.g. tcp://localhost:9912.
+	SchedulerAddress string
+	//SchedulerTimeout is how long to wait for a reply from the scheduler.
+	SchedulerTimeout time.Duration
+	//AgentTimeout is how long to wait for a reply from an agent. For streamed commands it is the
+	//longest gap between messages, since agents send keepalives while a command runs.
+	AgentTimeout time.Duration
+	//User and Password are sent with every request except pings.
+	User     string
+	Password string
+	//Credentials, if set, is called for every request that needs credentials and overrides User
+	//and Password, e.g. to prompt for a password only when one is needed.
+	Credentials func() (user string, password string)
+	//ServerKeys are the Z85 public keys of the scheduler and agents, by connect string such as
+	//tcp://web1:9924 or by host name. ServerKey is the key of servers not in ServerKeys. If either
+	//is set every connection uses CURVE with the client keypair ClientPublicKey and
+	//ClientSecretKey, and fails for a server without a key.
+	ServerKeys      map[string]string
+	ServerKey       string
+	ClientPublicKey string
+	ClientSecretKey string
+	//Logger receives debug output, nil for none.
+	Logger *log.Logger
+}
+
+//Client sends requests to the scheduler and agents. It holds no connections, every request uses
+//a socket of its own, so a Client is safe for concurrent use.
+type Client struct {
+	opts Options
+}
+
+//New returns a Client using opts.
+func New(opts Options) *Client {
+	if opts.SchedulerTimeout == 0 {
+		opts.SchedulerTimeout = DefaultSchedulerTimeout
+	}
+	if opts.AgentTimeout == 0 {
+		opts.AgentTimeout = DefaultAgentTimeout
+	}
+	return &Client{opts}
+}
+
+//Agent returns the agent at the 0MQ connect string address, for requests that go to a particular
+//agent rather than the preferred agent of an app.
+func (c *Client) Agent(address string) *Agent {
+	return &Agent{c, address}
+}
+
+//Lookup returns the connect string of the PreferredAgent for appID, see Agents. If the scheduler
+//has marked every agent dead ErrAgentDead is returned.
+func (c *Client) Lookup(ctx context.Context, appID string) (string, error) {
+	agents, err := c.Agents(ctx, appID)
+	if err != nil {
+		return "", err
+	}
+	preferred, ok := PreferredAgent(agents)
+	if !ok {
+		return "", ErrAgentDead
+	}
+	return preferred.Address, nil
+}
+
+//Agents returns the agents of appID and their Status in order of preference.
+func (c *Client) Agents(ctx context.Context, appID string) ([]AgentState, error) {
+	reply, err := c.schedulerReq(ctx, &SchedulerMsg{MsgType: SchedLookup, AppID: appID})
+	if err != nil {
+		return nil, err
+	}
+	if reply.MsgType != SchedReply {
+		return nil, schedReplyError(reply)
+	}
+	if len(reply.AppAgents) == 0 { //Schedulers before AppAgents reply with a single agent.
+		return []AgentState{{reply.Address, reply.Status}}, nil
+	}
+	return reply.AppAgents, nil
+}
+
+//List returns the AppIDs matching the glob pattern with their agents, and the agents known to
+//the scheduler. An empty pattern matches every AppID, a non-empty agent selects the apps on and
+//the info of that agent only. Only the AppIDs the user may look up are returned.
+func (c *Client) List(ctx context.Context, pattern string, agent string) ([]SchedEntry, []AgentInfo, error) {
+	reply, err := c.schedulerReq(ctx, &SchedulerMsg{MsgType: SchedList, AppID: pattern, Address: agent})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := schedTooOld(reply, CapList); err != nil {
+		return nil, nil, err
+	}
+	if reply.MsgType != SchedReply {
+		return nil, nil, schedReplyError(reply)
+	}
+	return reply.Apps, reply.Agents, nil
+}
+
+//Set maps appID to the agent connect strings in the scheduler, the first is the primary. The tags
+//of the app are replaced unless tags is nil.
+func (c *Client) Set(ctx context.Context, appID string, agents []string, tags []string) error {
+	if len(agents) == 0 {
+		return errors.New("at least one agent is required")
+	}
+	req := SchedulerMsg{MsgType: SchedSet, AppID: appID, Address: agents[0], Tags: tags}
+	for _, agent := range agents {
+		req.AppAgents = append(req.AppAgents, AgentState{Address: agent})
+	}
+	reply, err := c.schedulerReq(ctx, &req)
+	if err != nil {
+		return err
+	}
+	if err := schedTooOld(reply, CapSet); err != nil {
+		return err
+	}
+	if reply.MsgType != SchedOk {
+		return schedReplyError(reply)
+	}
+	return nil
+}
+
+//Unset removes the mapping for appID from the scheduler.
+func (c *Client) Unset(ctx context.Context, appID string) error {
+	reply, err := c.schedulerReq(ctx, &SchedulerMsg{MsgType: SchedUnset, AppID: appID})
+	if err != nil {
+		return err
+	}
+	if err := schedTooOld(reply, CapUnset); err != nil {
+		return err
+	}
+	if reply.MsgType != SchedOk {
+		return schedReplyError(reply)
+	}
+	return nil
+}
+
+//Register registers the agent described by info with the scheduler. Registered and the fields
+//the scheduler keeps itself are ignored.
+func (c *Client) Register(ctx context.Context, info AgentInfo) error {
+	reply, err := c.schedulerReq(ctx, &SchedulerMsg{MsgType: SchedRegister, Address: info.Address,
+		Hostname: info.Hostname, Version: info.Version, AppIDs: info.AppIDs})
+	if err != nil {
+		return err
+	}
+	if err := schedTooOld(reply, CapRegister); err != nil {
+		return err
+	}
+	if reply.MsgType != SchedOk {
+		return schedReplyError(reply)
+	}
+	return nil
+}
+
+//Heartbeat tells the scheduler the registered agent at address is alive. ErrNotRegistered means
+//the scheduler has forgotten the agent, e.g. after a restart, and it must Register again.
+func (c *Client) Heartbeat(ctx context.Context, address string) error {
+	reply, err := c.schedulerReq(ctx, &SchedulerMsg{MsgType: SchedHeartbeat, Address: address})
+	if err != nil {
+		return err
+	}
+	switch {
+	case reply.MsgType == SchedOk:
+		return nil
+	case reply.MsgType == SchedNotFound:
+		return ErrNotRegistered
+	}
+	if err := schedTooOld(reply, CapRegister); err != nil {
+		return err
+	}
+	return schedReplyError(reply)
+}
+
+//PingScheduler checks the scheduler is alive and returns its Capabilities, including the state of
+//its scheduler DB.
+func (c *Client) PingScheduler(ctx context.Context) (Capabilities, error) {
+	reply, err := c.schedulerReq(ctx, &SchedulerMsg{MsgType: SchedPing})
+	if err != nil {
+		return Capabilities{}, err
+	}
+	if reply.MsgType != SchedPingReply {
+		return Capabilities{}, schedReplyError(reply)
+	}
+	if reply.Proto == 0 {
+		return Capabilities{Proto: 1, Caps: schedCapsV1}, nil
+	}
+	return Capabilities{Proto: reply.Proto, Caps: reply.Caps, SchedulerDB: reply.DB}, nil
+}
+
+//AgentResult is the outcome of a request on one of the agents of an app, see StartAll.
+type AgentResult struct {
+	Agent  string //Connect string of the agent
+	Output string
+	Err    error
+}
+
+//StartAll runs ~/bin/start of appID on every agent of the app at once and returns the result of
+//each, in the order of Agents. Agents the scheduler marked dead get ErrAgentDead without being
+//contacted. The error is that of the lookup, failures of the agents are in the results.
+func (c *Client) StartAll(ctx context.Context, appID string) ([]AgentResult, error) {
+	agents, err := c.Agents(ctx, appID)
+	if err != nil {
+		return nil, err
+	}
+	return c.EachAgent(agents, func(i int, a *Agent) (string, error) { return a.Start(ctx, appID, nil) }), nil
+}
+
+//StopAll runs ~/bin/stop of appID on every agent of the app at once, see StartAll.
+func (c *Client) StopAll(ctx context.Context, appID string) ([]AgentResult, error) {
+	agents, err := c.Agents(ctx, appID)
+	if err != nil {
+		return nil, err
+	}
+	return c.EachAgent(agents, func(i int, a *Agent) (string, error) { return a.Stop(ctx, appID, nil) }), nil
+}
+
+//RestartAll restarts appID on every agent of the app at once, see StartAll.
+func (c *Client) RestartAll(ctx context.Context, appID string) ([]AgentResult, error) {
+	agents, err := c.Agents(ctx, appID)
+	if err != nil {
+		return nil, err
+	}
+	return c.EachAgent(agents, func(i int, a *Agent) (string, error) { return a.Restart(ctx, appID, nil) }), nil
+}
+
+//EachAgent calls fn for each of agents, e.g. some of those returned by Agents, each on its own go
+//routine, and returns the results in the order of agents. i is the index of the agent. Agents
+//marked dead get ErrAgentDead without fn being called.
+func (c *Client) EachAgent(agents []AgentState, fn func(i int, a *Agent) (string, error)) []AgentResult {
+	results := make([]AgentResult, len(agents))
+	var wg sync.WaitGroup
+	for i, state := range agents {
+		results[i].Agent = state.Address
+		if state.Status == AgentDead {
+			results[i].Err = ErrAgentDead
+			continue
+		}
+		wg.Add(1)
+		go func(i int, r *AgentResult) {
+			defer wg.Done()
+			r.Output, r.Err = fn(i, c.Agent(r.Agent))
+		}(i, &results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+//Start runs ~/bin/start of appID on its preferred agent only and returns the output. Use
+//StartAll for an app with several agents.
+func (c *Client) Start(ctx context.Context, appID string) (string, error) {
+	agent, err := c.Lookup(ctx, appID)
+	if err != nil {
+		return "", err
+	}
+	return c.Agent(agent).Start(ctx, appID, nil)
+}
+
+//Stop runs ~/bin/stop of appID on its preferred agent only and returns the output. Use StopAll
+//for an app with several agents.
+func (c *Client) Stop(ctx context.Context, appID string) (string, error) {
+	agent, err := c.Lookup(ctx, appID)
+	if err != nil {
+		return "", err
+	}
+	return c.Agent(agent).Stop(ctx, appID, nil)
+}
+
+//Restart restarts appID on its preferred agent only and returns the output. Use RestartAll for
+//an app with several agents.
+func (c *Client) Restart(ctx context.Context, appID string) (string, error) {
+	agent, err := c.Lookup(ctx, appID)
+	if err != nil {
+		return "", err
+	}
+	return c.Agent(agent).Restart(ctx, appID, nil)
+}
+
+//Status returns the AppStatus of appID on its preferred agent only. For the status on every agent
+//call Agent(address).Status for each of Agents.
+func (c *Client) Status(ctx context.Context, appID string) (*AppStatus, error) {
+	agent, err := c.Lookup(ctx, appID)
+	if err != nil {
+		return nil, err
+	}
+	return c.Agent(agent).Status(ctx, appID)
+}
+
+//Ps returns the processes of appID on its preferred agent only. For the processes on every agent
+//call Agent(address).Ps for each of Agents.
+func (c *Client) Ps(ctx context.Context, appID string) ([]ProcInfo, error) {
+	agent, err := c.Lookup(ctx, appID)
+	if err != nil {
+		return nil, err
+	}
+	return c.Agent(agent).Ps(ctx, appID)
+}
+
+//Kill sends the named signal to process pid of appID on its preferred agent. A pid only means
+//something on one host, so for an app with several agents use Agent(address).Kill on the agent
+//that reported it.
+func (c *Client) Kill(ctx context.Context, appID string, pid int, signal string) (string, error) {
+	agent, err := c.Lookup(ctx, appID)
+	if err != nil {
+		return "", err
+	}
+	return c.Agent(agent).Kill(ctx, appID, pid, signal)
+}
+
+//Logs tails the log files of appID on its preferred agent, see Agent.Logs. For an app with
+//several agents use Agent(address).Logs on the one wanted.
+func (c *Client) Logs(ctx context.Context, appID string, args LogArgs, sink OutputSink) (string, error) {
+	agent, err := c.Lookup(ctx, appID)
+	if err != nil {
+		return "", err
+	}
+	return c.Agent(agent).Logs(ctx, appID, args, sink)
+}
+
+func (c *Client) debugf(format string, v ...interface{}) {
+	if c.opts.Logger != nil {
+		c.opts.Logger.Printf(format, v...)
+	}
+}
+
+//credentials returns the user and password sent with requests.
+func (c *Client) credentials() (string, string) {
+	if c.opts.Credentials != nil {
+		return c.opts.Credentials()
+	}
+	return c.opts.User, c.opts.Password
+}
+
+//serverKey returns the CURVE public key of the server at endpoint, see Options.ServerKeys.
+func (c *Client) serverKey(endpoint string) string {
+	if key, ok := c.opts.ServerKeys[endpoint]; ok {
+		return key
+	}
+	if key, ok := c.opts.ServerKeys[EndpointHost(endpoint)]; ok {
+		return key
+	}
+	return c.opts.ServerKey
+}
+
+//EndpointHost returns the host part of a connect string such as tcp://host:9924.
+func EndpointHost(endpoint string) string {
+	if i := strings.Index(endpoint, "://"); i >= 0 {
+		endpoint = endpoint[i+3:]
+	}
+	if i := strings.LastIndex(endpoint, ":"); i >= 0 {
+		endpoint = endpoint[:i]
+	}
+	return strings.Trim(endpoint, "[]")
+}
+
+//connect returns a socket of type kind connected to endpoint, using CURVE if Options.ServerKeys
+//or Options.ServerKey is set.
+func (c *Client) connect(kind zmq.Type, endpoint string) (*zmq.Socket, error) {
+	curve := c.opts.ServerKey != "" || len(c.opts.ServerKeys) > 0
+	serverKey := c.serverKey(endpoint)
+	if curve && serverKey == "" {
+		return nil, fmt.Errorf("no CURVE server key for %s", endpoint)
+	}
+	socket, err := zmq.NewSocket(kind)
+	if err != nil {
+		return nil, err
+	}
+	if curve {
+		if err := socket.ClientAuthCurve(serverKey, c.opts.ClientPublicKey, c.opts.ClientSecretKey); err != nil {
+			socket.Close()
+			return nil, err
+		}
+	}
+	//Do not hold on to unsent requests when the socket is closed after a timeout.
+	socket.SetLinger(0)
+	if err := socket.Connect(endpoint); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	return socket, nil
+}
+
+//wait polls socket until it has a message, timeout passes or ctx is done. Returns false if
+//timeout passed and ctx.Err() if ctx is done first.
+func wait(ctx context.Context, socket *zmq.Socket, timeout time.Duration) (bool, error) {
+	poller := zmq.NewPoller()
+	poller.Add(socket, zmq.POLLIN)
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return false, nil
+		}
+		if left > pollInterval {
+			left = pollInterval
+		}
+		if d, ok := ctx.Deadline(); ok && time.Until(d) < left {
+			left = time.Until(d) + time.Millisecond
+		}
+		sockets, err := poller.Poll(left)
+		if err != nil {
+			return false, err // Interrupted by a syscall?
+		}
+		if len(sockets) > 0 {
+			return true, nil
+		}
+	}
+}
+
+//schedulerReq sends req to the scheduler and returns the reply. Credentials are added to every
+//request except SchedPing.
+func (c *Client) schedulerReq(ctx context.Context, req *SchedulerMsg) (*SchedulerMsg, error) {
+	c.debugf("schedulerReq(%d) to %s\n", req.MsgType, c.opts.SchedulerAddress)
+	if req.MsgType != SchedPing {
+		req.User, req.Password = c.credentials()
+	}
+	req.Proto = ProtocolVersion
+
+	requester, err := c.connect(zmq.REQ, c.opts.SchedulerAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer requester.Close()
+
+	jsonOut, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := requester.SendBytes(jsonOut, 0); err != nil {
+		return nil, err
+	}
+	ok, err := wait(ctx, requester, c.opts.SchedulerTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		c.debugf("schedulerReq() timeout\n")
+		return nil, ErrSchedulerTimeout
+	}
+	jsonReply, err := requester.RecvBytes(0)
+	if err != nil {
+		return nil, err
+	}
+	c.debugf("schedulerReq() Recv msg: %s\n", jsonReply)
+
+	var reply SchedulerMsg
+	if err := json.Unmarshal(jsonReply, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
@@ -0,0 +1,149 @@
+//
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+//ErrAgentTimeout is returned when an agent does not reply within Options.AgentTimeout, i.e. the
+//agent is down or unreachable.
+var ErrAgentTimeout = errors.New("agent did not reply, it may be down or unreachable")
+
+//ErrSchedulerTimeout is returned when the scheduler does not reply, i.e. it is down or unreachable.
+var ErrSchedulerTimeout = errors.New("scheduler did not reply, it may be down or unreachable")
+
+//ErrAppNotFound is returned when the scheduler has no agent for an AppID.
+var ErrAppNotFound = errors.New("AppID not found")
+
+//ErrAgentDead is returned when the agents for an AppID stopped sending heartbeats to the scheduler.
+var ErrAgentDead = errors.New("agent missed its heartbeats, it may be down or unreachable")
+
+//ErrNotRegistered is returned by Heartbeat when the scheduler does not know the agent, it has to
+//Register again.
+var ErrNotRegistered = errors.New("agent is not registered with the scheduler")
+
+//ErrUnauthorized is returned for bad credentials. Which of user and password is wrong is
+//deliberately not disclosed to the caller.
+var ErrUnauthorized = errors.New("unauthorized")
+
+//ErrForbidden is returned when the credentials are good but the user may not perform the
+//operation, or not on the AppID. Servers that predate it reply ErrUnauthorized for both.
+var ErrForbidden = errors.New("operation not permitted")
+
+//ErrExecTimeout is returned when a command ran past its execution deadline on the agent and its
+//process group was killed.
+var ErrExecTimeout = errors.New("command exceeded its execution timeout and was killed")
+
+//ErrAgentUnsupported is returned when the agent does not know the request, see TooOldError for
+//requests whose capability is known.
+var ErrAgentUnsupported = errors.New("agent does not support this request, it may be too old")
+
+//ErrSchedulerUnsupported is returned when the scheduler does not know the request, see
+//TooOldError for requests whose capability is known.
+var ErrSchedulerUnsupported = errors.New("scheduler does not support this request, it may be too old")
+
+//CommandError is returned when a command run by the agent exited non-zero. ExitCode is -1 if it
+//was killed by a signal.
+type CommandError struct {
+	ExitCode int
+	Message  string
+}
+
+func (e *CommandError) Error() string {
+	return e.Message
+}
+
+//TooOldError is returned when an agent or the scheduler lacks a capability a request needs.
+type TooOldError struct {
+	Server string //"agent" or "scheduler"
+	Cap    string
+	Proto  int
+}
+
+func (e *TooOldError) Error() string {
+	return fmt.Sprintf("%s too old for %s (it speaks protocol %d, this webtools %d)", e.Server, e.Cap, e.Proto, ProtocolVersion)
+}
+
+//PlainPsError is returned by Ps when the agent replied with plain ps output instead of ProcInfo
+//records, as agents speaking protocol version 1 do. Output is that reply.
+type PlainPsError struct {
+	Output string
+}
+
+func (e *PlainPsError) Error() string {
+	return "agent replied with plain ps output"
+}
+
+//agentReplyError converts the error in a failed agent reply to an error value. Execution
+//timeouts, denied requests, failed commands and unsupported requests map to ErrExecTimeout,
+//ErrUnauthorized or ErrForbidden, CommandError and ErrAgentUnsupported so callers can tell them
+//apart from other failures.
+func agentReplyError(reply *AgentMsg) error {
+	switch {
+	case reply.MsgType == MsgAgentUnsupported:
+		return ErrAgentUnsupported
+	case reply.MsgType == MsgAgentExecTimeout:
+		return ErrExecTimeout
+	case reply.MsgType == MsgAgentDenied:
+		return deniedError(reply.Error)
+	case reply.ExitCode != 0:
+		return &CommandError{reply.ExitCode, reply.Error}
+	}
+	return errors.New(reply.Error)
+}
+
+//deniedError returns the error of a denied request, whose reason is sent as its text.
+func deniedError(reason string) error {
+	if reason == ErrForbidden.Error() {
+		return ErrForbidden
+	}
+	return ErrUnauthorized
+}
+
+//schedReplyError returns the error reported by a scheduler reply.
+func schedReplyError(reply *SchedulerMsg) error {
+	switch {
+	case reply.MsgType == SchedNotFound:
+		return ErrAppNotFound
+	case reply.MsgType == SchedDenied:
+		return deniedError(reply.Error)
+	case reply.MsgType == SchedUnknown:
+		return ErrSchedulerUnsupported
+	case reply.Error != "":
+		return errors.New(reply.Error)
+	}
+	return fmt.Errorf("unexpected scheduler reply %d", reply.MsgType)
+}
+
+//agentTooOld returns a TooOldError if reply shows the agent does not support want: it answered
+//MsgAgentUnsupported, or it speaks protocol version 1 and want is not in agentCapsV1.
+func agentTooOld(reply *AgentMsg, want string) error {
+	proto := reply.Proto
+	if proto == 0 {
+		proto = 1
+	}
+	switch {
+	case reply.MsgType == MsgAgentUnsupported:
+		return &TooOldError{"agent", want, proto}
+	case reply.Proto == 0 && !containsString(agentCapsV1, want):
+		return &TooOldError{"agent", want, proto}
+	}
+	return nil
+}
+
+//schedTooOld returns a TooOldError if reply shows the scheduler does not support want: it
+//answered SchedUnknown, or it speaks protocol version 1 and want is not in schedCapsV1.
+func schedTooOld(reply *SchedulerMsg, want string) error {
+	proto := reply.Proto
+	if proto == 0 {
+		proto = 1
+	}
+	switch {
+	case reply.MsgType == SchedUnknown:
+		return &TooOldError{"scheduler", want, proto}
+	case reply.Proto == 0 && !containsString(schedCapsV1, want):
+		return &TooOldError{"scheduler", want, proto}
+	}
+	return nil
+}
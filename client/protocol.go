@@ -0,0 +1,295 @@
+//
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+//ProtocolVersion is the version of the AgentMsg and SchedulerMsg protocol spoken by this package.
+//It is sent in the Proto field of every message. Version 1 is everything before the Proto field
+//existed, such messages have Proto 0. Version 2 added Proto, the capability list in ping replies,
+//MsgAgentUnsupported and fixed message type numbers.
+const ProtocolVersion = 2
+
+//MsgAgentStartApp through MsgAgentUnsupported are the MsgType of agent requests and replies. The
+//numbers are part of the protocol, existing ones must never change, new types get the next one.
+const (
+	MsgAgentStartApp     = 0
+	MsgAgentStopApp      = 1
+	MsgAgentPs           = 2
+	MsgAgentPing         = 3
+	MsgAgentPingReply    = 4
+	MsgAgentKillPid      = 5
+	MsgAgentForceKillPid = 6
+	MsgAgentError        = 7
+	MsgAgentDenied       = 8
+	MsgAgentExecTimeout  = 9
+	MsgAgentRestartApp   = 10
+	MsgAgentStatusApp    = 11
+	MsgAgentOutput       = 12
+	MsgAgentLogs         = 13
+	MsgAgentUnsupported  = 14
+)
+
+//SchedLookup, SchedReply, SchedSet, SchedOk, SchedError, SchedUnknown, SchedNotFound, SchedPing,
+//SchedPingReply, SchedUnset, SchedDenied, SchedRegister, SchedHeartbeat and SchedList are constants used in request specific
+//actions from the scheduler by the CLI and agents in 0MQ messages. The numbers are part of the
+//protocol, existing ones must never change, new types get the next one.
+const (
+	SchedLookup    = 0
+	SchedReply     = 1
+	SchedSet       = 2
+	SchedOk        = 3
+	SchedError     = 4
+	SchedUnknown   = 5
+	SchedNotFound  = 6
+	SchedPing      = 7
+	SchedPingReply = 8
+	SchedUnset     = 9
+	SchedDenied    = 10
+	SchedRegister  = 11
+	SchedHeartbeat = 12
+	SchedList      = 13
+)
+
+//CapStart through CapTags are the capabilities listed in ping replies. Most are operations, the
+//names checked by the PasswordDB. CapStream is streamed command output, CapSignal a kill with
+//KillArgs, CapList SchedList, CapMultiAgent AppAgents and CapTags app tags.
+const (
+	CapStart      = "start"
+	CapStop       = "stop"
+	CapRestart    = "restart"
+	CapStatus     = "status"
+	CapLogs       = "logs"
+	CapPs         = "ps"
+	CapKill       = "kill"
+	CapLookup     = "lookup"
+	CapSet        = "set"
+	CapUnset      = "unset"
+	CapRegister   = "register"
+	CapStream     = "stream"
+	CapSignal     = "signal"
+	CapList       = "list"
+	CapMultiAgent = "multiagent"
+	CapTags       = "tags"
+)
+
+//agentCapsV1 are the capabilities of agents speaking protocol version 1, which do not list them.
+var agentCapsV1 = []string{CapStart, CapStop, CapPs, CapKill}
+
+//schedCapsV1 are the capabilities of schedulers speaking protocol version 1.
+var schedCapsV1 = []string{CapLookup}
+
+//AgentMsg is a struct that represents requests and replies to an agent from the CLI.
+//The MsgData field is an operation specific JSON encoded structure. User and Password are
+//the callers credentials, they are checked against the PasswordDB for every request except MsgAgentPing.
+//
+//A request with Stream set asks the agent to send command output as it is produced. The agent
+//then sends any number of MsgAgentOutput messages, each holding a chunk of output in MsgData
+//and the file descriptor it was written to (1 or 2) in Fd, before the final reply. Messages with
+//Fd 0 carry no output and only show the agent is still working. Streaming needs a DEALER socket
+//on the client.
+//
+//ExitCode is set in a MsgAgentError reply when a command ran and exited non-zero, -1 if it was
+//killed by a signal.
+//
+//Proto is the ProtocolVersion of the sender, 0 for agents and clients that predate it. A
+//MsgAgentPingReply lists the capabilities of the agent in Caps, and a request of a MsgType the
+//agent does not know is answered with MsgAgentUnsupported.
+type AgentMsg struct {
+	MsgType  int
+	AppID    string
+	MsgData  string
+	Error    string
+	User     string   `json:",omitempty"`
+	Password string   `json:",omitempty"`
+	Stream   bool     `json:",omitempty"`
+	Fd       int      `json:",omitempty"`
+	ExitCode int      `json:",omitempty"`
+	Proto    int      `json:",omitempty"`
+	Caps     []string `json:",omitempty"`
+}
+
+//String returns the JSON encoding of m with the password masked, for logging.
+func (m AgentMsg) String() string {
+	if m.Password != "" {
+		m.Password = "********"
+	}
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+//SchedulerMsg is a struct that represents requests and responses between the scheduler and CLI.
+//They are sent JSON encoded as 0MQ messages. User and Password are the callers credentials,
+//they are checked against the PasswordDB for every request except SchedPing. Hostname, Version
+//and AppIDs describe an agent in SchedRegister, Tags replace those of the app in SchedSet.
+//AppAgents are the agents of the app in SchedSet and SchedReply, in order of preference. Address
+//and Status of a SchedReply are those of its PreferredAgent, Status is AgentAlive or AgentDead.
+//A SchedList request filters with a glob in AppID and an agent in Address, its reply holds Apps
+//and Agents. Proto is the ProtocolVersion of the sender, 0 for programs that predate it, and a
+//SchedPingReply lists the capabilities of the scheduler in Caps and the state of its scheduler
+//DB in DB.
+type SchedulerMsg struct {
+	MsgType   int
+	AppID     string
+	Address   string
+	Error     string
+	User      string             `json:",omitempty"`
+	Password  string             `json:",omitempty"`
+	Hostname  string             `json:",omitempty"`
+	Version   string             `json:",omitempty"`
+	AppIDs    []string           `json:",omitempty"`
+	Status    string             `json:",omitempty"`
+	Tags      []string           `json:",omitempty"`
+	AppAgents []AgentState       `json:",omitempty"`
+	Apps      []SchedEntry       `json:",omitempty"`
+	Agents    []AgentInfo        `json:",omitempty"`
+	Proto     int                `json:",omitempty"`
+	Caps      []string           `json:",omitempty"`
+	DB        *SchedulerDBStatus `json:",omitempty"`
+}
+
+//SchedulerDBStatus is the state of the scheduler DB, as reported by the scheduler ping reply.
+//Loaded is when the DB in service was loaded and Apps the number of AppIDs in it. If the last
+//reload failed ReloadError holds why and ReloadFailed when, and the DB loaded before stays in
+//service.
+type SchedulerDBStatus struct {
+	Apps         int
+	Loaded       time.Time
+	ReloadError  string `json:",omitempty"`
+	ReloadFailed time.Time
+}
+
+//String returns the JSON encoding of m with the password masked, for logging.
+func (m SchedulerMsg) String() string {
+	if m.Password != "" {
+		m.Password = "********"
+	}
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+//OutputSink receives command output as it is written, fd is 1 for stdout and 2 for stderr.
+//p must not be retained after the call returns.
+type OutputSink func(fd int, p []byte)
+
+//KillArgs is the MsgData of a MsgAgentKillPid request. Signal is a signal name without the SIG
+//prefix. For compatibility a bare PID is also accepted and means SIGTERM.
+type KillArgs struct {
+	Pid    int
+	Signal string
+}
+
+//ProcInfo describes one process of an app. A MsgAgentPs reply carries a JSON encoded
+//[]ProcInfo in MsgData.
+type ProcInfo struct {
+	Pid        int
+	PPid       int
+	Cmdline    string
+	RSS        int64 //Resident set size in bytes
+	CPUSeconds float64
+	StartTime  time.Time
+	State      string
+}
+
+//AppStatus is the JSON encoded MsgData of a MsgAgentStatusApp reply. ExitCode and Output are
+//from ~/bin/status and only meaningful if HasStatusScript is set.
+type AppStatus struct {
+	HasStatusScript bool
+	ExitCode        int
+	Output          string
+	Running         bool
+	Processes       int
+}
+
+//LogArgs is the MsgData of a MsgAgentLogs request. File is relative to the apps home directory,
+//if it is empty every file allowed by the apps log paths is shown. Lines is the number of lines
+//to show from the end of each file, Follow keeps streaming lines as they are appended.
+type LogArgs struct {
+	File   string
+	Lines  int
+	Follow bool
+}
+
+//AgentAlive, AgentDead and AgentUnreachable are the Status of an agent reported in lookups.
+//Agents the scheduler has not heard from or pinged yet have no Status. Only registered agents
+//that missed their heartbeats are dead. Agents of the SchedulerDB that did not answer the last
+//ping of the scheduler are unreachable, which is advisory: the scheduler may not reach an agent
+//its clients can, so they are still tried.
+const (
+	AgentAlive       = "alive"
+	AgentDead        = "dead"
+	AgentUnreachable = "unreachable"
+)
+
+//AgentState is the connect string of one of the agents of an app and its Status.
+type AgentState struct {
+	Address string
+	Status  string `json:",omitempty"`
+}
+
+//PreferredAgent returns the first agent of agents that is alive or, failing that, not known to
+//be dead, unreachable agents included. Returns false if every agent is dead.
+func PreferredAgent(agents []AgentState) (AgentState, bool) {
+	for _, a := range agents {
+		if a.Status == AgentAlive {
+			return a, true
+		}
+	}
+	for _, a := range agents {
+		if a.Status != AgentDead {
+			return a, true
+		}
+	}
+	return AgentState{}, false
+}
+
+//AgentInfo is an agent known to the scheduler. Registered agents describe themselves and send
+//heartbeats, agents only found in the SchedulerDB are pinged by the scheduler instead. LastSeen is
+//the last heartbeat or successful ping, LastError the result of the last failed ping.
+type AgentInfo struct {
+	Address    string
+	Hostname   string   `json:",omitempty"`
+	Version    string   `json:",omitempty"`
+	AppIDs     []string `json:",omitempty"`
+	Registered bool
+	LastSeen   time.Time
+	LastError  string `json:",omitempty"`
+	Status     string
+}
+
+//SchedEntry is an AppID and its agents, as returned by SchedList. Address and Status are those of
+//its PreferredAgent. Owner, Created and Tags are those of its AppRecord, apps only served by
+//registered agents have none.
+type SchedEntry struct {
+	AppID   string
+	Address string
+	Status  string `json:",omitempty"`
+	Agents  []AgentState
+	Owner   string `json:",omitempty"`
+	Created time.Time
+	Tags    []string `json:",omitempty"`
+}
+
+//Capabilities are the protocol version and capabilities of an agent or the scheduler, as reported
+//by their ping reply. SchedulerDB is only set by schedulers that report it.
+type Capabilities struct {
+	Proto       int
+	Caps        []string
+	SchedulerDB *SchedulerDBStatus
+}
+
+//Has reports whether c includes capability want.
+func (c Capabilities) Has(want string) bool {
+	return containsString(c.Caps, want)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+//
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	zmq "github.com/pebbe/zmq4"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+//curveDomain is the ZAP domain of the scheduler and agent sockets.
+const curveDomain = "webtools"
+
+//CurveKeypair is a CURVE public and secret key, Z85 encoded.
+type CurveKeypair struct {
+	Public string
+	Secret string
+}
+
+var curveAuthOnce sync.Once
+
+//curveAuthRunning is set once StartCurveAuth started the ZAP handler.
+var curveAuthRunning bool
+
+//NewCurveKeypair creates a new random CurveKeypair.
+func NewCurveKeypair() (CurveKeypair, error) {
+	public, secret, err := zmq.NewCurveKeypair()
+	return CurveKeypair{public, secret}, err
+}
+
+//LoadCurveKeypair reads the keypair file at path, as written by SaveCurveKeypair. A leading ~/
+//is the home directory of the current user.
+func LoadCurveKeypair(path string) (CurveKeypair, error) {
+	var kp CurveKeypair
+	in, err := ioutil.ReadFile(expandHome(path))
+	if err != nil {
+		return kp, err
+	}
+	for _, line := range strings.Split(string(in), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "public="):
+			kp.Public = strings.TrimPrefix(line, "public=")
+		case strings.HasPrefix(line, "secret="):
+			kp.Secret = strings.TrimPrefix(line, "secret=")
+		}
+	}
+	if len(kp.Public) != 40 || len(kp.Secret) != 40 {
+		return kp, fmt.Errorf("%s: not a webtools keypair file", path)
+	}
+	return kp, nil
+}
+
+//SaveCurveKeypair writes kp to path, readable only by its owner, and the public key alone to
+//path.pub.
+func SaveCurveKeypair(kp CurveKeypair, path string) error {
+	path = expandHome(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	out := fmt.Sprintf("# webtools CURVE keypair, keep secret\npublic=%s\nsecret=%s\n", kp.Public, kp.Secret)
+	if err := writeFileAtomic(path, []byte(out), 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(path+".pub", []byte(kp.Public+"\n"), 0644)
+}
+
+//LoadCurvePublicKey reads a public key file, one Z85 key on the first line that is not blank or
+//a comment.
+func LoadCurvePublicKey(path string) (string, error) {
+	keys, err := loadCurveKeys(path)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("%s: no public key", path)
+	}
+	return keys[0], nil
+}
+
+//LoadCurveServerKeys reads the public keys of the scheduler and agents from the file at path,
+//one per line as a connect string or host name followed by the Z85 key, e.g.
+//"tcp://web1:9924 <key>" or "web1 <key>". Blank lines and lines starting with # are ignored,
+//text after the key is a comment.
+func LoadCurveServerKeys(path string) (map[string]string, error) {
+	f, err := os.Open(expandHome(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields[1]) != 40 {
+			return nil, fmt.Errorf("%s: %q is not a server and a Z85 public key", path, scanner.Text())
+		}
+		keys[fields[0]] = fields[1]
+	}
+	return keys, scanner.Err()
+}
+
+//loadCurveKeys reads the Z85 public keys in the file at path, one per line. Blank lines and
+//lines starting with # are ignored, text after the key is a comment.
+func loadCurveKeys(path string) ([]string, error) {
+	f, err := os.Open(expandHome(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields[0]) != 40 {
+			return nil, fmt.Errorf("%s: %q is not a Z85 public key", path, fields[0])
+		}
+		keys = append(keys, fields[0])
+	}
+	return keys, scanner.Err()
+}
+
+//StartCurveAuth starts the ZAP handler that admits the client keys in WT_CURVEAUTHORIZEDKEYS to
+//the scheduler and agent sockets, and arranges for them to be reloaded on SIGHUP. It must be
+//called before those sockets are bound and does nothing unless WT_CURVE is set.
+func StartCurveAuth() {
+	if !config.Curve {
+		return
+	}
+	curveAuthOnce.Do(func() {
+		if err := zmq.AuthStart(); err != nil {
+			log.Fatalln("zmq.AuthStart: ", err)
+		}
+		curveAuthRunning = true
+		if err := loadAuthorizedKeys(); err != nil {
+			log.Fatalln("loadAuthorizedKeys: ", err)
+		}
+		go curveSigHUPHandler()
+	})
+}
+
+//StopCurveAuth stops the ZAP handler started by StartCurveAuth, if any.
+func StopCurveAuth() {
+	if curveAuthRunning {
+		zmq.AuthStop()
+	}
+}
+
+//loadAuthorizedKeys replaces the client keys the ZAP handler admits with those in
+//WT_CURVEAUTHORIZEDKEYS.
+func loadAuthorizedKeys() error {
+	keys, err := loadCurveKeys(config.CurveAuthorizedKeys)
+	if err != nil {
+		return err
+	}
+	zmq.AuthCurveRemoveAll(curveDomain)
+	zmq.AuthCurveAdd(curveDomain, keys...)
+	log.Printf("Loaded %d authorized CURVE client keys from %s\n", len(keys), config.CurveAuthorizedKeys)
+	return nil
+}
+
+//curveSigHUPHandler causes the authorized client keys to be reloaded on receipt of SIGHUP. Should be run as a separate go routine.
+func curveSigHUPHandler() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for {
+		<-c //block until we receive SIGHUP
+		err := loadAuthorizedKeys()
+		if err != nil {
+			log.Println("loadAuthorizedKeys: ", err)
+		}
+		Metrics.Reload("authorized_keys", err)
+	}
+}
+
+//curveServer makes socket a CURVE server with the keypair in WT_CURVESERVERKEY, if WT_CURVE is
+//set. Each server has a keypair of its own, clients find its public key in WT_CURVESERVERKEYS.
+//Call it before binding socket.
+func curveServer(socket *zmq.Socket) error {
+	if !config.Curve {
+		return nil
+	}
+	kp, err := LoadCurveKeypair(config.CurveServerKey)
+	if err != nil {
+		return err
+	}
+	return socket.ServerAuthCurve(curveDomain, kp.Secret)
+}
+
+//expandHome replaces a leading ~/ in path with the home directory of the current user.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	u, err := user.Current()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(u.HomeDir, path[2:])
+}
+
+//ErrKeyExists is returned by GenerateKeyFile rather than overwrite an existing keypair.
+var ErrKeyExists = errors.New("keypair file exists, remove it first")
+
+//GenerateKeyFile creates a new CurveKeypair and saves it to path, see SaveCurveKeypair.
+func GenerateKeyFile(path string) (CurveKeypair, error) {
+	if _, err := os.Stat(expandHome(path)); err == nil {
+		return CurveKeypair{}, ErrKeyExists
+	}
+	kp, err := NewCurveKeypair()
+	if err != nil {
+		return kp, err
+	}
+	return kp, SaveCurveKeypair(kp, path)
+}
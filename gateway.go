@@ -0,0 +1,346 @@
+//
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ictusa/webtools/client"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//gatewayReadTimeout is how long a client has to send a request, gatewayIdleTimeout how long a
+//kept alive connection waits for the next one. Request bodies are small, so slow clients are
+//cut off rather than allowed to hold connections open.
+const (
+	gatewayReadTimeout = 10 * time.Second
+	gatewayIdleTimeout = 2 * time.Minute
+)
+
+//gatewayReply is the JSON body of the reply of the HTTP gateway to kill, and of the reply of each
+//agent to start, stop and restart. Error is set if the operation failed, ExitCode if it failed
+//because the command on the content server exited non-zero.
+type gatewayReply struct {
+	AppID    string
+	Agent    string `json:",omitempty"`
+	Output   string
+	Error    string `json:",omitempty"`
+	ExitCode int    `json:",omitempty"`
+}
+
+//gatewayKill is the JSON body of a POST /apps/{id}/kill. Signal defaults to TERM.
+type gatewayKill struct {
+	Pid    int
+	Signal string
+}
+
+//GatewayService serves the HTTP/JSON gateway on WT_GATEWAYLISTEN, with TLS if WT_GATEWAYCERT and
+//WT_GATEWAYKEY are set. Without TLS it only listens on a loopback address, unless
+//WT_GATEWAYINSECURE is set. Every request needs HTTP basic authentication, the credentials are
+//passed on to the scheduler and agents which authorize them as they do for the CLI. Should be run
+//as a separate go routine, it returns once services are stopping and the running requests are
+//answered, or cut off at the end of the grace period.
+func GatewayService() {
+	if config.Debug {
+		log.Println("GatewayService()")
+	}
+	tls := config.GatewayCert != "" && config.GatewayKey != ""
+	if !tls && !config.GatewayInsecure && !loopbackAddress(config.GatewayListen) {
+		log.Fatalln("GatewayService(): refusing to serve plain HTTP on", config.GatewayListen,
+			"set WT_GATEWAYCERT and WT_GATEWAYKEY, listen on a loopback address, or set WT_GATEWAYINSECURE=true")
+	}
+	if _, err := newClient(nil); err != nil {
+		log.Fatalln("GatewayService() client:", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apps", gatewayApps)
+	mux.HandleFunc("/apps/", gatewayApp)
+	//No WriteTimeout, a restart may run for as long as WT_AGENTEXECTIMEOUTS allows.
+	server := &http.Server{Addr: config.GatewayListen, Handler: mux,
+		ReadHeaderTimeout: gatewayReadTimeout, ReadTimeout: gatewayReadTimeout, IdleTimeout: gatewayIdleTimeout}
+
+	stopped := make(chan bool)
+	go func() {
+		<-services.stopping.Done()
+		if err := server.Shutdown(services.killing); err != nil {
+			services.CutOff("running gateway requests")
+			server.Close()
+		}
+		close(stopped)
+	}()
+
+	var err error
+	if tls {
+		log.Println("Gateway listening on https", config.GatewayListen)
+		err = server.ListenAndServeTLS(config.GatewayCert, config.GatewayKey)
+	} else {
+		log.Println("Gateway listening on http", config.GatewayListen, "without TLS, passwords are sent in the clear")
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalln("GatewayService():", err)
+	}
+	<-stopped
+}
+
+//loopbackAddress reports whether the host of the listen address addr is a loopback address.
+func loopbackAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+//gatewayClient returns a client.Client that sends the basic authentication credentials of r, or
+//replies 401 and returns nil if r has none.
+func gatewayClient(w http.ResponseWriter, r *http.Request) *client.Client {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		gatewayError(w, http.StatusUnauthorized, ErrUnauthorized)
+		return nil
+	}
+	c, err := newClient(func() (string, string) { return user, password })
+	if err != nil {
+		gatewayError(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	return c
+}
+
+//gatewayApps serves GET /apps, the apps visible to the user with their agents. The optional
+//query parameters glob and agent filter them as in webtools scheduler list.
+func gatewayApps(w http.ResponseWriter, r *http.Request) {
+	if config.Debug {
+		log.Println("gatewayApps(", r.Method, r.URL, ")")
+	}
+	if r.Method != http.MethodGet {
+		gatewayMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	c := gatewayClient(w, r)
+	if c == nil {
+		return
+	}
+	apps, _, err := c.List(r.Context(), r.FormValue("glob"), r.FormValue("agent"))
+	if err != nil {
+		gatewayError(w, gatewayStatus(err), err)
+		return
+	}
+	gatewayJSON(w, http.StatusOK, apps)
+}
+
+//gatewayApp serves the requests for a single app, /apps/{id} and /apps/{id}/{op}. The query
+//parameter host selects agents by connect string or host name as --host does for the CLI. start,
+//stop and restart run on every selected agent at once, kill needs a single agent, ps and status
+//run on the preferred one.
+func gatewayApp(w http.ResponseWriter, r *http.Request) {
+	if config.Debug {
+		log.Println("gatewayApp(", r.Method, r.URL, ")")
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/apps/"), "/")
+	if len(parts) > 2 || parts[0] == "" {
+		gatewayError(w, http.StatusNotFound, ErrAppNotFound)
+		return
+	}
+	appid, op := parts[0], ""
+	if len(parts) == 2 {
+		op = parts[1]
+	}
+
+	method := http.MethodPost
+	switch op {
+	case "", "ps", "status":
+		method = http.MethodGet
+	case "start", "stop", "restart", "kill":
+	default:
+		gatewayError(w, http.StatusNotFound, errors.New("no such operation "+op))
+		return
+	}
+	if r.Method != method {
+		gatewayMethodNotAllowed(w, method)
+		return
+	}
+	//A form cannot be posted with this content type across sites, which guards against CSRF.
+	if method == http.MethodPost && !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		gatewayError(w, http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/json"))
+		return
+	}
+	c := gatewayClient(w, r)
+	if c == nil {
+		return
+	}
+	ctx := r.Context()
+
+	var args gatewayKill
+	if op == "kill" {
+		if err := gatewayKillArgs(r, &args); err != nil {
+			gatewayError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	agents, err := c.Agents(ctx, appid)
+	if err != nil {
+		gatewayError(w, gatewayStatus(err), err)
+		return
+	}
+	if host := r.URL.Query().Get("host"); host != "" {
+		if agents = selectAgents(agents, strings.Split(host, ",")); len(agents) == 0 {
+			gatewayError(w, http.StatusNotFound, fmt.Errorf("no agent of AppID %s matches host %s", appid, host))
+			return
+		}
+	}
+	switch op {
+	case "":
+		gatewayJSON(w, http.StatusOK, agents)
+		return
+	case "start", "stop", "restart":
+		gatewayFanOut(w, r, c, appid, op, agents)
+		return
+	case "kill":
+		if len(agents) > 1 {
+			gatewayError(w, http.StatusBadRequest, fmt.Errorf("AppID %s has %d agents, select one with ?host=", appid, len(agents)))
+			return
+		}
+	}
+	preferred, ok := PreferredAgent(agents)
+	if !ok {
+		gatewayError(w, gatewayStatus(ErrAgentDead), ErrAgentDead)
+		return
+	}
+	a := c.Agent(preferred.Address)
+	switch op {
+	case "ps":
+		procs, err := a.Ps(ctx, appid)
+		if plain, ok := err.(*client.PlainPsError); ok {
+			gatewayJSON(w, http.StatusOK, gatewayReply{AppID: appid, Agent: preferred.Address, Output: plain.Output})
+			return
+		}
+		if err != nil {
+			gatewayError(w, gatewayStatus(err), err)
+			return
+		}
+		gatewayJSON(w, http.StatusOK, procs)
+	case "status":
+		status, err := a.Status(ctx, appid)
+		if err != nil {
+			gatewayError(w, gatewayStatus(err), err)
+			return
+		}
+		gatewayJSON(w, http.StatusOK, status)
+	case "kill":
+		reply := gatewayReply{AppID: appid, Agent: preferred.Address}
+		reply.Output, err = a.Kill(ctx, appid, args.Pid, args.Signal)
+		status := gatewayReplyError(&reply, err)
+		gatewayJSON(w, status, reply)
+	}
+}
+
+//gatewayFanOut runs a start, stop or restart on every agent at once and replies with a
+//gatewayReply per agent, in the order of agents. The status is that of the first failure, as
+//the exit status of the CLI. Agents the scheduler marked dead are not contacted. The client
+//streams the commands, so a slow start or restart is not taken for an unreachable agent.
+func gatewayFanOut(w http.ResponseWriter, r *http.Request, c *client.Client, appid string, op string, agents []AgentState) {
+	ctx := r.Context()
+	results := c.EachAgent(agents, func(i int, a *client.Agent) (string, error) {
+		switch op {
+		case "start":
+			return a.Start(ctx, appid, nil)
+		case "stop":
+			return a.Stop(ctx, appid, nil)
+		}
+		return a.Restart(ctx, appid, nil)
+	})
+	replies := make([]gatewayReply, len(results))
+	status := http.StatusOK
+	for i, result := range results {
+		replies[i] = gatewayReply{AppID: appid, Agent: result.Agent, Output: result.Output}
+		if s := gatewayReplyError(&replies[i], result.Err); status == http.StatusOK {
+			status = s
+		}
+	}
+	gatewayJSON(w, status, replies)
+}
+
+//gatewayReplyError records err in reply and returns the HTTP status for it.
+func gatewayReplyError(reply *gatewayReply, err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	reply.Error = err.Error()
+	if cmdErr, ok := err.(*CommandError); ok {
+		reply.ExitCode = cmdErr.ExitCode
+	}
+	return gatewayStatus(err)
+}
+
+//gatewayKillArgs reads the pid and signal of a kill from the JSON body.
+func gatewayKillArgs(r *http.Request, args *gatewayKill) error {
+	if err := json.NewDecoder(r.Body).Decode(args); err != nil {
+		return err
+	}
+	if args.Pid <= 0 {
+		return errors.New("Pid is required")
+	}
+	if args.Signal == "" {
+		args.Signal = "TERM"
+	}
+	signal, err := ParseSignal(args.Signal)
+	args.Signal = signal
+	return err
+}
+
+//gatewayStatus maps an error returned by the scheduler and agent requests to an HTTP status code.
+func gatewayStatus(err error) int {
+	switch {
+	case err == ErrUnauthorized:
+		return http.StatusUnauthorized
+	case err == ErrForbidden:
+		return http.StatusForbidden
+	case err == ErrAppNotFound:
+		return http.StatusNotFound
+	case err == ErrSchedulerTimeout, err == ErrAgentTimeout, err == ErrExecTimeout:
+		return http.StatusGatewayTimeout
+	case err == ErrAgentDead:
+		return http.StatusServiceUnavailable
+	case err == ErrAgentUnsupported, err == ErrSchedulerUnsupported:
+		return http.StatusNotImplemented
+	}
+	switch err.(type) {
+	case *CommandError:
+		return http.StatusInternalServerError
+	case *TooOldError:
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadGateway
+}
+
+func gatewayError(w http.ResponseWriter, status int, err error) {
+	gatewayJSON(w, status, struct{ Error string }{err.Error()})
+}
+
+func gatewayMethodNotAllowed(w http.ResponseWriter, method string) {
+	w.Header().Set("Allow", method)
+	gatewayJSON(w, http.StatusMethodNotAllowed, struct{ Error string }{"method not allowed, use " + method})
+}
+
+//gatewayJSON replies with status and v as JSON. A 401 asks for basic authentication, for missing
+//and for rejected credentials alike. Good credentials not allowed the operation get a 403.
+func gatewayJSON(w http.ResponseWriter, status int, v interface{}) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="webtools"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,148 @@
+//
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//logPathsFile holds the log path whitelist of an app, one glob per line relative to the apps
+//home directory. Blank lines and lines starting with # are ignored.
+const logPathsFile = ".webtools/logpaths"
+
+//defaultLogPaths is the log path whitelist of apps without a logPathsFile.
+var defaultLogPaths = []string{"logs/*.log"}
+
+//ErrLogNotAllowed is returned for a log file outside the apps home directory or whitelist.
+var ErrLogNotAllowed = errors.New("log file not allowed, see ~/" + logPathsFile)
+
+//AgentLogs runs tail as the Unix user of appid on the log files selected by args. Output is
+//streamed to sink when following. A follow ends when ctx is cancelled, i.e. the client went away,
+//or after WT_AGENTLOGFOLLOWMAX seconds.
+func AgentLogs(ctx context.Context, appid string, data string, sink OutputSink) (string, error) {
+	u, err := user.Lookup(appid)
+	if err != nil {
+		return "", err
+	}
+	var args LogArgs
+	if err := json.Unmarshal([]byte(data), &args); err != nil {
+		return "", fmt.Errorf("malformed logs request: %s", err)
+	}
+	if args.Lines < 0 {
+		return "", fmt.Errorf("invalid line count %d", args.Lines)
+	}
+
+	files, err := logFiles(u, args.File)
+	if err != nil {
+		return "", err
+	}
+
+	cmdLine := []string{"/usr/bin/tail", "-n", strconv.Itoa(args.Lines)}
+	timeout := execTimeout(OpLogs)
+	if args.Follow {
+		cmdLine = append(cmdLine, "-F")
+		timeout = time.Duration(config.AgentLogFollowMax) * time.Second
+	}
+	cmdLine = append(cmdLine, "--")
+	cmdLine = append(cmdLine, files...)
+
+	output, err := runCommand(ctx, u, cmdLine, u.HomeDir, timeout, sink)
+	if args.Follow && (err == ErrExecTimeout || (err != nil && err == ctx.Err())) {
+		return output, nil //The end of a follow is not a failure.
+	}
+	return output, err
+}
+
+//logFiles returns the absolute paths of the log files of u that a logs request for file may
+//read. file must resolve, after following symlinks, to a path inside the home directory of u
+//that matches one of the apps log path globs. An empty file selects every matching file.
+func logFiles(u *user.User, file string) ([]string, error) {
+	home, err := filepath.EvalSymlinks(u.HomeDir)
+	if err != nil {
+		return nil, err
+	}
+	patterns, err := logPaths(home)
+	if err != nil {
+		return nil, err
+	}
+
+	if file == "" {
+		var files []string
+		for _, pattern := range patterns {
+			matches, _ := filepath.Glob(filepath.Join(home, pattern))
+			for _, match := range matches {
+				resolved, err := filepath.EvalSymlinks(match)
+				if err == nil && allowedLog(home, patterns, resolved) {
+					files = append(files, resolved)
+				}
+			}
+		}
+		if len(files) == 0 {
+			return nil, errors.New("no log files match the log paths in ~/" + logPathsFile)
+		}
+		return files, nil
+	}
+
+	path := file
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(home, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, ErrLogNotAllowed //Don't reveal which files exist.
+	}
+	if !allowedLog(home, patterns, resolved) {
+		return nil, ErrLogNotAllowed
+	}
+	return []string{resolved}, nil
+}
+
+//allowedLog reports whether the resolved path is inside home and matches one of patterns.
+func allowedLog(home string, patterns []string, path string) bool {
+	rel, err := filepath.Rel(home, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//logPaths reads the log path whitelist of the app with home directory home.
+func logPaths(home string) ([]string, error) {
+	f, err := os.Open(filepath.Join(home, logPathsFile))
+	if os.IsNotExist(err) {
+		return defaultLogPaths, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := filepath.Clean(line)
+		if filepath.IsAbs(pattern) || pattern == ".." || strings.HasPrefix(pattern, ".."+string(filepath.Separator)) {
+			continue //Globs may only select files in the home directory.
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, scanner.Err()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedLog(t *testing.T) {
+	home := "/home/app"
+	patterns := []string{"logs/*.log", "var/app.log", "logs/*/access.log"}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/home/app/logs/app.log", true},
+		{"/home/app/var/app.log", true},
+		{"/home/app/logs/web/access.log", true},
+		{"/home/app/logs/app.txt", false},
+		{"/home/app/logs/web/app.log", false}, //* does not match /
+		{"/home/app/var/other.log", false},
+		{"/home/app", false},
+		{"/home/app/.webtools/logpaths", false},
+		{"/home/app2/logs/app.log", false},
+		{"/home/other/logs/app.log", false},
+		{"/home/logs/app.log", false},
+		{"/etc/passwd", false},
+		{"/", false},
+	}
+	for _, test := range tests {
+		if got := allowedLog(home, patterns, test.path); got != test.want {
+			t.Errorf("allowedLog(%q, %q, %q) = %v, want %v", home, patterns, test.path, got, test.want)
+		}
+	}
+}
+
+//TestLogFiles checks that logs only reads files inside the home directory that match the globs in
+//~/.webtools/logpaths, however the file is named and wherever symlinks point.
+func TestLogFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "webtools-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		t.Fatal(err)
+	}
+	home := filepath.Join(root, "app")
+	outside := filepath.Join(root, "other")
+	for _, dir := range []string{"logs", "var", ".webtools"} {
+		if err := os.MkdirAll(filepath.Join(home, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"app/logs/a.log", "app/logs/b.log", "app/var/c.log", "app/secret.txt", "other/d.log"} {
+		if err := ioutil.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"app/logs/escape.log": filepath.Join(outside, "d.log"), //Out of the home directory
+		"app/logs/passwd.log": "/etc/passwd",
+		"app/logs/c.log":      "../var/c.log", //Inside, to a file the globs do not allow
+		"app/logs/secret.log": "../secret.txt",
+		"app/logs/other":      outside,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logpaths := "# Log files of app\n\nlogs/*.log\n/etc/*\n../other/*.log\nlogs/../../other/*.log\nlogs/other/*.log\n"
+	if err := ioutil.WriteFile(filepath.Join(home, logPathsFile), []byte(logpaths), 0644); err != nil {
+		t.Fatal(err)
+	}
+	u := &user.User{Username: "app", HomeDir: home}
+
+	allowed := map[string]string{
+		"logs/a.log":                      filepath.Join(home, "logs/a.log"),
+		"./logs/../logs/b.log":            filepath.Join(home, "logs/b.log"),
+		filepath.Join(home, "logs/a.log"): filepath.Join(home, "logs/a.log"),
+	}
+	for file, want := range allowed {
+		got, err := logFiles(u, file)
+		if err != nil || len(got) != 1 || got[0] != want {
+			t.Errorf("logFiles(%q) = %q, %v, want %q", file, got, err, want)
+		}
+	}
+	for _, file := range []string{
+		"../other/d.log",
+		"logs/../../other/d.log",
+		filepath.Join(outside, "d.log"),
+		"/etc/passwd",
+		"logs/escape.log",
+		"logs/passwd.log",
+		"logs/c.log",
+		"logs/secret.log",
+		"logs/other/d.log",
+		"secret.txt",
+		"var/c.log",
+		".webtools/logpaths",
+		"logs/missing.log",
+		"logs/*.log",
+	} {
+		if got, err := logFiles(u, file); err != ErrLogNotAllowed {
+			t.Errorf("logFiles(%q) = %q, %v, want ErrLogNotAllowed", file, got, err)
+		}
+	}
+
+	got, err := logFiles(u, "")
+	want := []string{filepath.Join(home, "logs/a.log"), filepath.Join(home, "logs/b.log")}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("logFiles(\"\") = %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestLogPaths(t *testing.T) {
+	home, err := ioutil.TempDir("", "webtools-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	if got, err := logPaths(home); err != nil || !reflect.DeepEqual(got, defaultLogPaths) {
+		t.Errorf("logPaths without %s = %q, %v, want %q", logPathsFile, got, err, defaultLogPaths)
+	}
+	if err := os.MkdirAll(filepath.Join(home, ".webtools"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	logpaths := "# comment\n\n  logs/*.log  \n/var/log/*.log\n..\n../x/*.log\nlogs/../../x.log\nlogs//app/../*.txt\n..hidden/*.log\n"
+	if err := ioutil.WriteFile(filepath.Join(home, logPathsFile), []byte(logpaths), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"logs/*.log", "logs/*.txt", "..hidden/*.log"}
+	if got, err := logPaths(home); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("logPaths = %q, %v, want %q", got, err, want)
+	}
+}
@@ -3,24 +3,55 @@
 package main
 
 import (
+	"fmt"
 	"github.com/kelseyhightower/envconfig"
 	"log"
 	"os"
 	"os/signal"
 	"os/user"
 	"syscall"
+	"time"
 )
 
 // Spec represents the webtools configuration via environment variables
 type Spec struct {
-	Debug            bool
-	DebugLvl         int
-	SchedulerAddress string
-	AppId            string
-	SchedulerDbPath  string
-	SchedulerListen  string
-	AgentListen      string
-	AgentTimeout     int64
+	Debug                bool
+	DebugLvl             int
+	SchedulerAddress     string
+	AppId                string
+	SchedulerDbPath      string
+	SchedulerListen      string
+	AgentListen          string
+	AgentTimeout         int64
+	PasswordDbPath       string
+	User                 string
+	Password             string
+	AgentWorkers         int
+	AgentExecTimeout     int64
+	AgentExecTimeouts    map[string]int64
+	AgentLogFollowMax    int64
+	AgentMaxFollowers    int
+	AgentMaxQueued       int
+	AgentAdvertise       string
+	AgentHeartbeat       int64
+	SchedulerStore       string
+	Curve                bool
+	CurveServerKey       string
+	CurveServerPublicKey string
+	CurveServerKeys      string
+	CurveClientKey       string
+	CurveAuthorizedKeys  string
+	GatewayListen        string
+	GatewayCert          string
+	GatewayKey           string
+	GatewayInsecure      bool
+	AuditLogPath         string
+	AuditMaxSize         int64
+	AuditKeep            int
+	AuditPings           bool
+	MetricsListen        string
+	ShutdownGrace        int64
+	SchedulerWatch       bool
 }
 
 // config holds the global application configuration
@@ -29,20 +60,32 @@ var config Spec
 //ServicesRunning determines wether webtools exists after ParseCli is done.
 var ServicesRunning bool
 
+//ExitStatus is the exit code of webtools once ParseCli is done, see the Exit constants in cli.go.
+var ExitStatus int
+
 // Initialize configuration variables to their default values
 func init() {
 	uid, uidErr := user.Current()
 	if uidErr != nil {
-		log.Fatal(uidErr)
+		fmt.Fprintln(os.Stderr, uidErr)
+		os.Exit(ExitFailure)
 	}
 	config = Spec{false, 0, "tcp://localhost:9912", uid.Username,
-		"/usr/local/etc/webtools/scheduler.json", "tcp://*:9912", "tcp://*:9924", 30}
+		"/usr/local/etc/webtools/scheduler.json", "tcp://*:9912", "tcp://*:9924", 30,
+		"/usr/local/etc/webtools/passwords.json", uid.Username, "", 8,
+		25, nil, 3600, 16, 8, "", 10, StoreJSON,
+		false, "/usr/local/etc/webtools/server.key", "/usr/local/etc/webtools/server.key.pub",
+		"/usr/local/etc/webtools/server_keys", "~/.webtools/client.key", "/usr/local/etc/webtools/authorized_keys",
+		"127.0.0.1:9980", "", "", false,
+		"/var/log/webtools/audit.log", 100, 5, false, "", 30, true}
 }
 
 func main() {
+	// A bad WT_ variable is a usage error, log.Fatal would exit 1 like a failed remote command.
 	err := envconfig.Process("wt", &config)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ExitUsage)
 	}
 	if len(os.Args) > 1 {
 		ParseCli(os.Args[1:len(os.Args)])
@@ -52,10 +95,18 @@ func main() {
 
 	if ServicesRunning {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGTERM)
-		<-c //block until we receive SIGTERM
-		log.Println("Webtools shutting down - SIGTERM received.")
-
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-c //block until we receive SIGINT or SIGTERM
+		log.Println("Webtools shutting down -", sig, "received.")
+		go func() {
+			sig := <-c
+			log.Println("Webtools exiting -", sig, "received again.")
+			os.Exit(ExitFailure)
+		}()
+		if !services.Shutdown(time.Duration(config.ShutdownGrace) * time.Second) {
+			ExitStatus = ExitFailure
+		}
 	}
+	os.Exit(ExitStatus)
 
 }
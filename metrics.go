@@ -0,0 +1,222 @@
+//
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//commandBuckets are the upper bounds in seconds of the webtools_agent_command_seconds buckets.
+var commandBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 60, 120, 300}
+
+//histogram counts observations in commandBuckets, Prometheus style. counts[i] is the number of
+//observations of at most commandBuckets[i], the last element those above every bucket.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(commandBuckets)+1)
+	}
+	i := sort.SearchFloat64s(commandBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+//reloadState is the outcome of the last reload of a database.
+type reloadState struct {
+	time time.Time
+	ok   bool
+}
+
+//requestKey identifies a webtools_requests_total series.
+type requestKey struct {
+	service string
+	op      string
+	result  string
+}
+
+//metrics are the counters of the agent and scheduler services exposed on WT_METRICSLISTEN.
+type metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+	commands map[string]*histogram
+	lookups  map[string]uint64
+	reloads  map[string]reloadState
+}
+
+//Metrics are the metrics of the services running in this process.
+var Metrics = &metrics{
+	requests: make(map[requestKey]uint64),
+	commands: make(map[string]*histogram),
+	lookups:  make(map[string]uint64),
+	reloads:  make(map[string]reloadState),
+}
+
+var metricsOnce sync.Once
+
+//StartMetrics serves the Metrics in the Prometheus text format on WT_METRICSLISTEN at /metrics,
+//if it is set. It is safe to call once per service, the services share the listener when run in
+//one process.
+func StartMetrics() {
+	if config.MetricsListen == "" {
+		return
+	}
+	metricsOnce.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", Metrics.serve)
+		go func() {
+			log.Println("Metrics listening on http", config.MetricsListen)
+			log.Fatalln("StartMetrics():", http.ListenAndServe(config.MetricsListen, mux))
+		}()
+	})
+}
+
+//Request counts a request handled by service, see AuditRecord for op and result.
+func (m *metrics) Request(service string, op string, result string) {
+	m.mu.Lock()
+	m.requests[requestKey{service, op, result}]++
+	m.mu.Unlock()
+}
+
+//Command records how long a command run for op, e.g. OpStart, took.
+func (m *metrics) Command(op string, d time.Duration) {
+	m.mu.Lock()
+	h, ok := m.commands[op]
+	if !ok {
+		h = &histogram{}
+		m.commands[op] = h
+	}
+	h.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+//Lookup counts a scheduler lookup that found agents for the AppID, or did not.
+func (m *metrics) Lookup(found bool) {
+	result := "miss"
+	if found {
+		result = "hit"
+	}
+	m.mu.Lock()
+	m.lookups[result]++
+	m.mu.Unlock()
+}
+
+//Reload records the outcome of a reload of db, e.g. "scheduler" or "passwords".
+func (m *metrics) Reload(db string, err error) {
+	m.mu.Lock()
+	m.reloads[db] = reloadState{time.Now(), err == nil}
+	m.mu.Unlock()
+}
+
+//serve writes the metrics in the Prometheus text exposition format.
+func (m *metrics) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	//Read the SchedulerDB before locking, it may be slow and must not hold up requests.
+	apps := -1
+	if SchedulerDB != nil {
+		if all, err := SchedulerDB.All(); err == nil {
+			apps = len(all)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP webtools_requests_total Requests handled by the agent and scheduler by operation and result.")
+	fmt.Fprintln(out, "# TYPE webtools_requests_total counter")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		if a.op != b.op {
+			return a.op < b.op
+		}
+		return a.result < b.result
+	})
+	for _, k := range keys {
+		fmt.Fprintf(out, "webtools_requests_total{service=%s,op=%s,result=%s} %d\n",
+			metricsLabel(k.service), metricsLabel(k.op), metricsLabel(k.result), m.requests[k])
+	}
+
+	fmt.Fprintln(out, "# HELP webtools_agent_command_seconds Time taken by the commands run for start and stop.")
+	fmt.Fprintln(out, "# TYPE webtools_agent_command_seconds histogram")
+	for _, op := range sortedKeys(m.commands) {
+		h := m.commands[op]
+		var cumulative uint64
+		for i, le := range commandBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(out, "webtools_agent_command_seconds_bucket{op=%s,le=\"%g\"} %d\n", metricsLabel(op), le, cumulative)
+		}
+		fmt.Fprintf(out, "webtools_agent_command_seconds_bucket{op=%s,le=\"+Inf\"} %d\n", metricsLabel(op), h.count)
+		fmt.Fprintf(out, "webtools_agent_command_seconds_sum{op=%s} %g\n", metricsLabel(op), h.sum)
+		fmt.Fprintf(out, "webtools_agent_command_seconds_count{op=%s} %d\n", metricsLabel(op), h.count)
+	}
+
+	fmt.Fprintln(out, "# HELP webtools_scheduler_lookups_total Scheduler lookups that found agents for the AppID (hit) or not (miss).")
+	fmt.Fprintln(out, "# TYPE webtools_scheduler_lookups_total counter")
+	for _, result := range []string{"hit", "miss"} {
+		fmt.Fprintf(out, "webtools_scheduler_lookups_total{result=%s} %d\n", metricsLabel(result), m.lookups[result])
+	}
+
+	if apps >= 0 {
+		fmt.Fprintln(out, "# HELP webtools_scheduler_db_apps AppIDs in the SchedulerDB.")
+		fmt.Fprintln(out, "# TYPE webtools_scheduler_db_apps gauge")
+		fmt.Fprintf(out, "webtools_scheduler_db_apps %d\n", apps)
+	}
+
+	fmt.Fprintln(out, "# HELP webtools_reload_timestamp_seconds Time of the last reload of a database, on SIGHUP or a change to the scheduler DB file.")
+	fmt.Fprintln(out, "# TYPE webtools_reload_timestamp_seconds gauge")
+	for _, db := range sortedKeys(m.reloads) {
+		fmt.Fprintf(out, "webtools_reload_timestamp_seconds{db=%s} %d\n", metricsLabel(db), m.reloads[db].time.Unix())
+	}
+	fmt.Fprintln(out, "# HELP webtools_reload_success Whether the last reload of a database succeeded.")
+	fmt.Fprintln(out, "# TYPE webtools_reload_success gauge")
+	for _, db := range sortedKeys(m.reloads) {
+		ok := 0
+		if m.reloads[db].ok {
+			ok = 1
+		}
+		fmt.Fprintf(out, "webtools_reload_success{db=%s} %d\n", metricsLabel(db), ok)
+	}
+}
+
+//sortedKeys returns the keys of a map of metrics by name in order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]reloadState:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//metricsLabel quotes a label value for the Prometheus text format.
+func metricsLabel(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
@@ -0,0 +1,368 @@
+//
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//PasswordEnt is a single user in the password database. Password is the bcrypt hash of the
+//users password, Roles selects which operations the user may perform and AppIDs selects which
+//apps they may perform them on. An AppID of "*" matches every app.
+type PasswordEnt struct {
+	Password []byte
+	Roles    []string
+	AppIDs   []string
+}
+
+//OpStart, OpStop, OpRestart, OpStatus, OpLogs, OpPs, OpKill, OpLookup, OpSet, OpUnset and
+//OpRegister are the operation names checked by Authorize. OpRegister covers agent registration
+//and heartbeats and is checked against AppID "", so only users with AppID * pass it.
+const (
+	OpStart    = "start"
+	OpStop     = "stop"
+	OpRestart  = "restart"
+	OpStatus   = "status"
+	OpLogs     = "logs"
+	OpPs       = "ps"
+	OpKill     = "kill"
+	OpLookup   = "lookup"
+	OpSet      = "set"
+	OpUnset    = "unset"
+	OpRegister = "register"
+)
+
+//RoleOps maps a role name to the operations it grants. "*" grants every operation.
+var RoleOps = map[string][]string{
+	"admin":     {"*"},
+	"developer": {OpStart, OpStop, OpRestart, OpStatus, OpLogs, OpPs, OpKill, OpLookup},
+	"readonly":  {OpStatus, OpLogs, OpPs, OpLookup},
+	"agent":     {OpRegister},
+}
+
+var passwordDbMutex sync.Mutex
+var passwordDbOnce sync.Once
+
+//PasswordDB maps a user name to its PasswordEnt
+var PasswordDB map[string]PasswordEnt
+
+func init() {
+	PasswordDB = make(map[string]PasswordEnt)
+}
+
+//LoadPasswordDB will load the PasswordDB map from the specified JSON file.
+func LoadPasswordDB(path string) error {
+	if config.Debug {
+		log.Println("LoadPasswordDB(", path, ")")
+	}
+	in, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		return readErr
+	}
+
+	db := make(map[string]PasswordEnt)
+	if err := json.Unmarshal(in, &db); err != nil {
+		return err
+	}
+
+	passwordDbMutex.Lock()
+	defer passwordDbMutex.Unlock()
+	PasswordDB = db
+	return nil
+}
+
+//StartPasswordDB loads the PasswordDB for the agent and scheduler services and arranges for it
+//to be reloaded on SIGHUP. It is safe to call once per service.
+func StartPasswordDB() {
+	passwordDbOnce.Do(func() {
+		if err := LoadPasswordDB(config.PasswordDbPath); err != nil {
+			log.Fatalln("LoadPasswordDB: ", err)
+		}
+		go PasswordSigHUPHandler()
+	})
+}
+
+//PasswordSigHUPHandler causes the PasswordDB to be reloaded on receipt of SIGHUP. Should be run as a separate go routine.
+func PasswordSigHUPHandler() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for {
+		<-c //block until we receive SIGHUP
+		log.Println("Reloading PasswordDB SIGHUP received.")
+		err := LoadPasswordDB(config.PasswordDbPath)
+		if err != nil {
+			log.Println("LoadPasswordDB: ", err)
+		}
+		Metrics.Reload("passwords", err)
+	}
+}
+
+//Authorize checks the credentials of user and that one of their roles allows op on appid. Bad
+//credentials are ErrUnauthorized, good ones that do not allow op on appid ErrForbidden.
+func Authorize(user string, password string, op string, appid string) error {
+	ent, err := Authenticate(user, password, op)
+	if err != nil {
+		return err
+	}
+	if !entAllowsApp(ent, appid) {
+		if config.Debug {
+			log.Printf("Authorize(%s, %s, %s) not permitted\n", user, op, appid)
+		}
+		return ErrForbidden
+	}
+	return nil
+}
+
+//Authenticate checks the credentials of user and that one of their roles allows op, it returns
+//their PasswordEnt so requests covering several apps can be filtered with AllowsApp. bcrypt is
+//slow by design, so a successful check is remembered for authCacheTTL, see authCache. Unknown
+//users are checked against a dummy hash, so they take as long as a bad password.
+func Authenticate(user string, password string, op string) (PasswordEnt, error) {
+	passwordDbMutex.Lock()
+	ent, ok := PasswordDB[user]
+	passwordDbMutex.Unlock()
+
+	if !ok || user == "" {
+		bcrypt.CompareHashAndPassword(authDummyHash(), []byte(password))
+		if config.Debug {
+			log.Printf("Authenticate(%s, %s) unknown user\n", user, op)
+		}
+		return PasswordEnt{}, ErrUnauthorized
+	}
+	key := newAuthCacheKey(user, ent.Password, password)
+	if !authCache.valid(key) {
+		if err := bcrypt.CompareHashAndPassword(ent.Password, []byte(password)); err != nil {
+			if config.Debug {
+				log.Printf("Authenticate(%s, %s) bad password\n", user, op)
+			}
+			return PasswordEnt{}, ErrUnauthorized
+		}
+		authCache.add(key)
+	}
+	if !entAllowsOp(ent, op) {
+		if config.Debug {
+			log.Printf("Authenticate(%s, %s) not permitted\n", user, op)
+		}
+		return PasswordEnt{}, ErrForbidden
+	}
+	return ent, nil
+}
+
+//authCacheTTL is how long a successful password check is remembered, and authCacheMax how many
+//are remembered at most.
+const (
+	authCacheTTL = time.Minute
+	authCacheMax = 1024
+)
+
+//authCacheKey identifies a successful password check by user, their bcrypt hash and the
+//password. The password is only kept as a SHA-256 hash, salted with the bcrypt hash so a change
+//of password in the PasswordDB does not match entries made before it.
+type authCacheKey struct {
+	user string
+	sum  [sha256.Size]byte
+}
+
+func newAuthCacheKey(user string, hash []byte, password string) authCacheKey {
+	h := sha256.New()
+	h.Write(hash)
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	key := authCacheKey{user: user}
+	copy(key.sum[:], h.Sum(nil))
+	return key
+}
+
+//authCache remembers successful password checks, so agents sending heartbeats and clients sending
+//several requests do not pay for bcrypt every time. The scheduler handles its requests one at a
+//time, so a bcrypt for each would cap how many it can serve.
+var authCache = &passwordCache{checked: make(map[authCacheKey]time.Time)}
+
+type passwordCache struct {
+	mu      sync.Mutex
+	checked map[authCacheKey]time.Time //When the check was made
+}
+
+//valid reports whether key was checked less than authCacheTTL ago.
+func (c *passwordCache) valid(key authCacheKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	checked, ok := c.checked[key]
+	return ok && time.Since(checked) < authCacheTTL
+}
+
+//add remembers key as checked now. When the cache is full expired entries are dropped, or every
+//entry if none has expired.
+func (c *passwordCache) add(key authCacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.checked) >= authCacheMax {
+		for k, checked := range c.checked {
+			if time.Since(checked) >= authCacheTTL {
+				delete(c.checked, k)
+			}
+		}
+		if len(c.checked) >= authCacheMax {
+			c.checked = make(map[authCacheKey]time.Time)
+		}
+	}
+	c.checked[key] = time.Now()
+}
+
+var authDummyOnce sync.Once
+var authDummy []byte
+
+//authDummyHash returns a bcrypt hash of the cost UserAdd uses, made on first use since that takes
+//as long as a password check.
+func authDummyHash() []byte {
+	authDummyOnce.Do(func() {
+		authDummy, _ = bcrypt.GenerateFromPassword([]byte("webtools"), bcrypt.DefaultCost)
+	})
+	return authDummy
+}
+
+//AllowsApp reports whether ent may operate on appid.
+func (ent PasswordEnt) AllowsApp(appid string) bool {
+	return entAllowsApp(ent, appid)
+}
+
+func entAllowsApp(ent PasswordEnt, appid string) bool {
+	for _, a := range ent.AppIDs {
+		if a == "*" || a == appid {
+			return true
+		}
+	}
+	return false
+}
+
+func entAllowsOp(ent PasswordEnt, op string) bool {
+	for _, role := range ent.Roles {
+		for _, o := range RoleOps[role] {
+			if o == "*" || o == op {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//UserAdd adds or replaces user in the password database at path.
+func UserAdd(path string, user string, password string, roles []string, appids []string) error {
+	for _, role := range roles {
+		if _, ok := RoleOps[role]; !ok {
+			return fmt.Errorf("unknown role %q", role)
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return editPasswordDB(path, func(db map[string]PasswordEnt) error {
+		db[user] = PasswordEnt{hash, roles, appids}
+		return nil
+	})
+}
+
+//UserDel removes user from the password database at path.
+func UserDel(path string, user string) error {
+	return editPasswordDB(path, func(db map[string]PasswordEnt) error {
+		if _, ok := db[user]; !ok {
+			return fmt.Errorf("no such user %q", user)
+		}
+		delete(db, user)
+		return nil
+	})
+}
+
+//UserPasswd changes the password of user in the password database at path.
+func UserPasswd(path string, user string, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return editPasswordDB(path, func(db map[string]PasswordEnt) error {
+		ent, ok := db[user]
+		if !ok {
+			return fmt.Errorf("no such user %q", user)
+		}
+		ent.Password = hash
+		db[user] = ent
+		return nil
+	})
+}
+
+//editPasswordDB reads the password database at path, applies edit and atomically writes it
+//back. A missing file is treated as an empty database.
+func editPasswordDB(path string, edit func(map[string]PasswordEnt) error) error {
+	db := make(map[string]PasswordEnt)
+	in, readErr := ioutil.ReadFile(path)
+	switch {
+	case readErr == nil:
+		if err := json.Unmarshal(in, &db); err != nil {
+			return err
+		}
+	case !os.IsNotExist(readErr):
+		return readErr
+	}
+
+	if err := edit(db); err != nil {
+		return err
+	}
+	out, jsonErr := json.MarshalIndent(db, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	return writeFileAtomic(path, append(out, '\n'), 0600)
+}
+
+//ReadPassword prompts for a password on the terminal without echo. If stdin is not a terminal
+//a single line is read from it instead, so passwords can be piped in by scripts.
+func ReadPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+var cliPasswordOnce sync.Once
+
+//cliCredentials returns the user name and password the CLI sends with its requests. If
+//WT_PASSWORD is not set the user is prompted once. Exits with ExitFailure if the password cannot
+//be read, not 1 which would look like the exit code of a remote command.
+func cliCredentials() (string, string) {
+	cliPasswordOnce.Do(func() {
+		if config.Password != "" {
+			return
+		}
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return
+		}
+		pw, err := ReadPassword(fmt.Sprintf("Password for %s: ", config.User))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ReadPassword:", err)
+			os.Exit(ExitFailure)
+		}
+		config.Password = pw
+	})
+	return config.User, config.Password
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+//testPasswordDB replaces the PasswordDB with users whose password is their name, for the duration
+//of a test.
+func testPasswordDB(t *testing.T, users map[string]PasswordEnt) {
+	db := make(map[string]PasswordEnt)
+	for user, ent := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(user), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ent.Password = hash
+		db[user] = ent
+	}
+	passwordDbMutex.Lock()
+	old := PasswordDB
+	PasswordDB = db
+	passwordDbMutex.Unlock()
+	t.Cleanup(func() {
+		passwordDbMutex.Lock()
+		PasswordDB = old
+		passwordDbMutex.Unlock()
+	})
+}
+
+func TestAuthorize(t *testing.T) {
+	testPasswordDB(t, map[string]PasswordEnt{
+		"root":   {Roles: []string{"admin"}, AppIDs: []string{"*"}},
+		"dev":    {Roles: []string{"developer"}, AppIDs: []string{"app1", "app2"}},
+		"viewer": {Roles: []string{"readonly"}, AppIDs: []string{"app1"}},
+		"agent":  {Roles: []string{"agent"}, AppIDs: []string{"*"}},
+		"both":   {Roles: []string{"readonly", "agent"}, AppIDs: []string{"app1"}},
+		"nobody": {Roles: []string{"unknown"}, AppIDs: []string{"*"}},
+	})
+	tests := []struct {
+		user, password, op, appid string
+		want                      error
+	}{
+		{"root", "root", OpSet, "app1", nil},
+		{"root", "root", OpRegister, "", nil},
+		{"root", "wrong", OpStatus, "app1", ErrUnauthorized},
+		{"dev", "dev", OpStart, "app1", nil},
+		{"dev", "dev", OpKill, "app2", nil},
+		{"dev", "dev", OpStart, "app3", ErrForbidden},
+		{"dev", "dev", OpSet, "app1", ErrForbidden},
+		{"dev", "dev", OpRegister, "", ErrForbidden},
+		{"dev", "", OpStart, "app1", ErrUnauthorized},
+		{"dev", "wrong", OpSet, "app1", ErrUnauthorized},
+		{"viewer", "viewer", OpStatus, "app1", nil},
+		{"viewer", "viewer", OpLookup, "app1", nil},
+		{"viewer", "viewer", OpStart, "app1", ErrForbidden},
+		{"viewer", "viewer", OpKill, "app1", ErrForbidden},
+		{"viewer", "viewer", OpStatus, "app2", ErrForbidden},
+		{"agent", "agent", OpRegister, "", nil},
+		{"agent", "agent", OpStart, "app1", ErrForbidden},
+		{"both", "both", OpRegister, "", ErrForbidden}, //Register needs AppID *
+		{"both", "both", OpPs, "app1", nil},
+		{"nobody", "nobody", OpStatus, "app1", ErrForbidden},
+		{"stranger", "stranger", OpStatus, "app1", ErrUnauthorized},
+		{"", "", OpStatus, "app1", ErrUnauthorized},
+	}
+	//Twice, the second time the successful password checks come from authCache.
+	for i := 0; i < 2; i++ {
+		for _, test := range tests {
+			if err := Authorize(test.user, test.password, test.op, test.appid); err != test.want {
+				t.Errorf("Authorize(%q, %q, %q, %q) = %v, want %v", test.user, test.password, test.op, test.appid, err, test.want)
+			}
+		}
+	}
+}
+
+//TestAuthenticateCachePasswordChange checks that a cached check does not outlive a change of the
+//password in the PasswordDB.
+func TestAuthenticateCachePasswordChange(t *testing.T) {
+	testPasswordDB(t, map[string]PasswordEnt{"dev": {Roles: []string{"developer"}, AppIDs: []string{"*"}}})
+	if _, err := Authenticate("dev", "dev", OpStart); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("changed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordDbMutex.Lock()
+	ent := PasswordDB["dev"]
+	ent.Password = hash
+	PasswordDB["dev"] = ent
+	passwordDbMutex.Unlock()
+
+	if _, err := Authenticate("dev", "dev", OpStart); err != ErrUnauthorized {
+		t.Errorf("Authenticate with the old password = %v, want ErrUnauthorized", err)
+	}
+	if _, err := Authenticate("dev", "changed", OpStart); err != nil {
+		t.Errorf("Authenticate with the new password = %v", err)
+	}
+}
+
+func TestEntAllowsOp(t *testing.T) {
+	tests := []struct {
+		roles []string
+		op    string
+		want  bool
+	}{
+		{[]string{"admin"}, OpUnset, true},
+		{[]string{"admin"}, "anything", true},
+		{[]string{"developer"}, OpRestart, true},
+		{[]string{"developer"}, OpLogs, true},
+		{[]string{"developer"}, OpSet, false},
+		{[]string{"developer"}, OpUnset, false},
+		{[]string{"readonly"}, OpPs, true},
+		{[]string{"readonly"}, OpStop, false},
+		{[]string{"agent"}, OpRegister, true},
+		{[]string{"agent"}, OpLookup, false},
+		{[]string{"readonly", "agent"}, OpRegister, true},
+		{[]string{"unknown"}, OpStatus, false},
+		{nil, OpStatus, false},
+	}
+	for _, test := range tests {
+		if got := entAllowsOp(PasswordEnt{Roles: test.roles}, test.op); got != test.want {
+			t.Errorf("entAllowsOp(%q, %q) = %v, want %v", test.roles, test.op, got, test.want)
+		}
+	}
+}
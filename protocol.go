@@ -0,0 +1,135 @@
+//
+package main
+
+import (
+	"fmt"
+	"github.com/ictusa/webtools/client"
+	"log"
+	"os"
+	"time"
+)
+
+//The messages of the agent and scheduler protocol and the errors their clients see are defined by
+//package client, which the CLI uses to send requests. The aliases below let the agent and
+//scheduler use them unqualified.
+type (
+	AgentMsg          = client.AgentMsg
+	SchedulerMsg      = client.SchedulerMsg
+	OutputSink        = client.OutputSink
+	KillArgs          = client.KillArgs
+	ProcInfo          = client.ProcInfo
+	AppStatus         = client.AppStatus
+	LogArgs           = client.LogArgs
+	AgentState        = client.AgentState
+	AgentInfo         = client.AgentInfo
+	SchedEntry        = client.SchedEntry
+	CommandError      = client.CommandError
+	TooOldError       = client.TooOldError
+	SchedulerDBStatus = client.SchedulerDBStatus
+)
+
+const ProtocolVersion = client.ProtocolVersion
+
+const (
+	MsgAgentStartApp     = client.MsgAgentStartApp
+	MsgAgentStopApp      = client.MsgAgentStopApp
+	MsgAgentPs           = client.MsgAgentPs
+	MsgAgentPing         = client.MsgAgentPing
+	MsgAgentPingReply    = client.MsgAgentPingReply
+	MsgAgentKillPid      = client.MsgAgentKillPid
+	MsgAgentForceKillPid = client.MsgAgentForceKillPid
+	MsgAgentError        = client.MsgAgentError
+	MsgAgentDenied       = client.MsgAgentDenied
+	MsgAgentExecTimeout  = client.MsgAgentExecTimeout
+	MsgAgentRestartApp   = client.MsgAgentRestartApp
+	MsgAgentStatusApp    = client.MsgAgentStatusApp
+	MsgAgentOutput       = client.MsgAgentOutput
+	MsgAgentLogs         = client.MsgAgentLogs
+	MsgAgentUnsupported  = client.MsgAgentUnsupported
+)
+
+const (
+	SchedLookup    = client.SchedLookup
+	SchedReply     = client.SchedReply
+	SchedSet       = client.SchedSet
+	SchedOk        = client.SchedOk
+	SchedError     = client.SchedError
+	SchedUnknown   = client.SchedUnknown
+	SchedNotFound  = client.SchedNotFound
+	SchedPing      = client.SchedPing
+	SchedPingReply = client.SchedPingReply
+	SchedUnset     = client.SchedUnset
+	SchedDenied    = client.SchedDenied
+	SchedRegister  = client.SchedRegister
+	SchedHeartbeat = client.SchedHeartbeat
+	SchedList      = client.SchedList
+)
+
+const (
+	AgentAlive       = client.AgentAlive
+	AgentDead        = client.AgentDead
+	AgentUnreachable = client.AgentUnreachable
+)
+
+var (
+	ErrAgentTimeout         = client.ErrAgentTimeout
+	ErrSchedulerTimeout     = client.ErrSchedulerTimeout
+	ErrAppNotFound          = client.ErrAppNotFound
+	ErrAgentDead            = client.ErrAgentDead
+	ErrUnauthorized         = client.ErrUnauthorized
+	ErrForbidden            = client.ErrForbidden
+	ErrExecTimeout          = client.ErrExecTimeout
+	ErrAgentUnsupported     = client.ErrAgentUnsupported
+	ErrSchedulerUnsupported = client.ErrSchedulerUnsupported
+)
+
+//PreferredAgent is client.PreferredAgent.
+func PreferredAgent(agents []AgentState) (AgentState, bool) {
+	return client.PreferredAgent(agents)
+}
+
+//agentCaps are the capabilities an agent lists in its ping reply.
+var agentCaps = []string{client.CapStart, client.CapStop, client.CapRestart, client.CapStatus, client.CapLogs,
+	client.CapPs, client.CapKill, client.CapStream, client.CapSignal}
+
+//schedCaps are the capabilities the scheduler lists in its ping reply.
+var schedCaps = []string{client.CapLookup, client.CapSet, client.CapUnset, client.CapRegister, client.CapList,
+	client.CapMultiAgent, client.CapTags}
+
+//newClient returns a client.Client for the scheduler at WT_SCHEDULERADDRESS with the agent timeout
+//and, if WT_CURVE is set, the CURVE keys of the environment: the server keys of
+//WT_CURVESERVERKEYS, WT_CURVESERVERPUBLICKEY for servers not listed there, and the client keypair. credentials supplies the user and
+//password sent with requests, it may be nil for a client that only pings.
+func newClient(credentials func() (string, string)) (*client.Client, error) {
+	opts := client.Options{
+		SchedulerAddress: config.SchedulerAddress,
+		AgentTimeout:     time.Duration(config.AgentTimeout) * time.Second,
+		Credentials:      credentials,
+	}
+	if config.Debug {
+		opts.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if config.Curve {
+		kp, err := LoadCurveKeypair(config.CurveClientKey)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("no CURVE client key at %s, create one with webtools keygen", config.CurveClientKey)
+			}
+			return nil, err
+		}
+		serverKeys, err := LoadCurveServerKeys(config.CurveServerKeys)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		serverKey, err := LoadCurvePublicKey(config.CurveServerPublicKey)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(serverKeys) == 0 && serverKey == "" {
+			return nil, fmt.Errorf("no CURVE server keys at %s or %s", config.CurveServerKeys, config.CurveServerPublicKey)
+		}
+		opts.ServerKeys, opts.ServerKey = serverKeys, serverKey
+		opts.ClientPublicKey, opts.ClientSecretKey = kp.Public, kp.Secret
+	}
+	return client.New(opts), nil
+}
@@ -0,0 +1,305 @@
+//
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ictusa/webtools/client"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//agentHeartbeatMisses is the number of heartbeats an agent may miss before the scheduler marks
+//it dead.
+const agentHeartbeatMisses = 3
+
+var agentRegistryMutex sync.Mutex
+
+//agentRegistry maps the connect string of each agent known to the scheduler to its AgentInfo.
+var agentRegistry = make(map[string]*AgentInfo)
+
+//agentPinging holds the agents with a ping in flight, so a slow agent is not pinged twice.
+var agentPinging = make(map[string]bool)
+
+//RegistryRegister records the agent described by info as alive, replacing an earlier
+//registration with the same Address.
+func RegistryRegister(info AgentInfo) {
+	agentRegistryMutex.Lock()
+	defer agentRegistryMutex.Unlock()
+	if old, ok := agentRegistry[info.Address]; !ok || !old.Registered || old.Status == AgentDead {
+		log.Printf("Agent %s (%s, version %s) registered for %d AppIDs\n", info.Address, info.Hostname, info.Version, len(info.AppIDs))
+	}
+	info.Registered = true
+	info.LastSeen = time.Now()
+	info.Status = AgentAlive
+	agentRegistry[info.Address] = &info
+}
+
+//RegistryHeartbeat records a heartbeat from the agent at address. Returns false if the agent is
+//not registered, it must register again.
+func RegistryHeartbeat(address string) bool {
+	agentRegistryMutex.Lock()
+	defer agentRegistryMutex.Unlock()
+	info, ok := agentRegistry[address]
+	if !ok || !info.Registered {
+		return false
+	}
+	if info.Status == AgentDead {
+		log.Printf("Agent %s is alive again\n", address)
+	}
+	info.LastSeen = time.Now()
+	info.Status = AgentAlive
+	return true
+}
+
+//RegistryLookup returns the registered agents serving appid, sorted by Address.
+func RegistryLookup(appid string) []AgentState {
+	agentRegistryMutex.Lock()
+	defer agentRegistryMutex.Unlock()
+	var found []AgentState
+	for _, info := range agentRegistry {
+		if info.Registered && containsString(info.AppIDs, appid) {
+			found = append(found, AgentState{Address: info.Address, Status: info.Status})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Address < found[j].Address })
+	return found
+}
+
+//RegistryStatus returns the Status of the agent at address, or "" if it is not known yet.
+func RegistryStatus(address string) string {
+	agentRegistryMutex.Lock()
+	defer agentRegistryMutex.Unlock()
+	if info, ok := agentRegistry[address]; ok {
+		return info.Status
+	}
+	return ""
+}
+
+//RegistryAgents returns a copy of every known agent, sorted by Address.
+func RegistryAgents() []AgentInfo {
+	agentRegistryMutex.Lock()
+	defer agentRegistryMutex.Unlock()
+	agents := make([]AgentInfo, 0, len(agentRegistry))
+	for _, info := range agentRegistry {
+		agents = append(agents, *info)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Address < agents[j].Address })
+	return agents
+}
+
+//RegistryReaper marks registered agents that missed agentHeartbeatMisses heartbeats dead, and
+//pings the agents in the SchedulerDB that did not register with c. Should be run as a separate go routine,
+//it returns when services are stopping.
+func RegistryReaper(c *client.Client) {
+	interval := time.Duration(config.AgentHeartbeat) * time.Second
+	for {
+		registryPingStatic(c)
+		select {
+		case <-time.After(interval):
+		case <-services.stopping.Done():
+			return
+		}
+		agentRegistryMutex.Lock()
+		for address, info := range agentRegistry {
+			if info.Registered && info.Status == AgentAlive && time.Since(info.LastSeen) > agentHeartbeatMisses*interval {
+				log.Printf("Agent %s missed %d heartbeats, marking it dead\n", address, agentHeartbeatMisses)
+				info.Status = AgentDead
+			}
+		}
+		agentRegistryMutex.Unlock()
+	}
+}
+
+//registryPingStatic pings every agent of the SchedulerDB that did not register, and forgets the
+//pinged agents no longer in the SchedulerDB.
+func registryPingStatic(c *client.Client) {
+	records, err := SchedulerDB.All()
+	if err != nil {
+		log.Println("registryPingStatic():", err)
+		return
+	}
+	static := make(map[string]bool)
+	for _, rec := range records {
+		for _, address := range rec.Agents {
+			static[address] = true
+		}
+	}
+
+	agentRegistryMutex.Lock()
+	defer agentRegistryMutex.Unlock()
+	for address, info := range agentRegistry {
+		if !info.Registered && !static[address] {
+			delete(agentRegistry, address)
+		}
+	}
+	for address := range static {
+		info, ok := agentRegistry[address]
+		if ok && info.Registered || agentPinging[address] {
+			continue
+		}
+		if !ok {
+			agentRegistry[address] = &AgentInfo{Address: address}
+		}
+		agentPinging[address] = true
+		go registryPing(c, address)
+	}
+}
+
+//registryPing pings the agent at address and records the result. An agent that does not answer
+//is marked unreachable, never dead, see AgentUnreachable.
+func registryPing(c *client.Client, address string) {
+	_, err := c.Agent(address).Ping(context.Background())
+
+	agentRegistryMutex.Lock()
+	defer agentRegistryMutex.Unlock()
+	delete(agentPinging, address)
+	info, ok := agentRegistry[address]
+	if !ok || info.Registered {
+		return
+	}
+	if err != nil {
+		info.LastError = err.Error()
+		if info.Status != AgentUnreachable {
+			log.Printf("Agent %s did not answer its ping, marking it unreachable: %s\n", address, err)
+			info.Status = AgentUnreachable
+		}
+		return
+	}
+	if info.Status == AgentUnreachable {
+		log.Printf("Agent %s is alive again\n", address)
+	}
+	info.LastSeen = time.Now()
+	info.LastError = ""
+	info.Status = AgentAlive
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+//AgentRegistration registers the agent with the scheduler at config.SchedulerAddress and then
+//sends a heartbeat every WT_AGENTHEARTBEAT seconds, registering again whenever the scheduler has
+//forgotten the agent, e.g. after a restart. Should be run as a separate go routine, it returns
+//when services are stopping.
+func AgentRegistration() {
+	address, err := agentAdvertise()
+	if err != nil {
+		log.Println("AgentRegistration(): not registering with the scheduler:", err)
+		return
+	}
+	c, err := newClient(func() (string, string) { return config.User, config.Password })
+	if err != nil {
+		log.Println("AgentRegistration(): not registering with the scheduler:", err)
+		return
+	}
+	interval := time.Duration(config.AgentHeartbeat) * time.Second
+	registered := false
+	for {
+		if !registered {
+			registered = agentRegister(c, address)
+		} else {
+			registered = agentHeartbeat(c, address)
+		}
+		select {
+		case <-time.After(interval):
+		case <-services.stopping.Done():
+			return
+		}
+	}
+}
+
+//agentRegister registers the agent at address with the scheduler. Returns true if the
+//scheduler accepted it.
+func agentRegister(c *client.Client, address string) bool {
+	hostname, _ := os.Hostname()
+	appids, err := localAppIDs()
+	if err != nil {
+		log.Println("agentRegister() localAppIDs:", err)
+	}
+	err = c.Register(context.Background(), AgentInfo{Address: address, Hostname: hostname, Version: Version, AppIDs: appids})
+	switch {
+	case err == ErrSchedulerTimeout:
+		if config.Debug {
+			log.Println("agentRegister():", err)
+		}
+		return false
+	case err != nil:
+		log.Println("agentRegister(): scheduler refused registration:", err)
+		return false
+	}
+	log.Printf("Registered %s with the scheduler at %s for %d AppIDs\n", address, config.SchedulerAddress, len(appids))
+	return true
+}
+
+//agentHeartbeat sends a heartbeat for the agent at address. Returns false if the agent has to
+//register again.
+func agentHeartbeat(c *client.Client, address string) bool {
+	err := c.Heartbeat(context.Background(), address)
+	switch {
+	case err == client.ErrNotRegistered:
+		return false
+	case err == ErrSchedulerTimeout:
+		if config.Debug {
+			log.Println("agentHeartbeat():", err)
+		}
+		//Keep trying, the scheduler marks us dead if this goes on.
+	case err != nil:
+		log.Println("agentHeartbeat():", err)
+	}
+	return true
+}
+
+//agentAdvertise returns the connect string the agent registers with. It is WT_AGENTADVERTISE if
+//set, otherwise the hostname and the port of WT_AGENTLISTEN.
+func agentAdvertise() (string, error) {
+	if config.AgentAdvertise != "" {
+		return config.AgentAdvertise, nil
+	}
+	i := strings.Index(config.AgentListen, "://")
+	if i < 0 {
+		return "", fmt.Errorf("cannot derive a connect string from WT_AGENTLISTEN=%s, set WT_AGENTADVERTISE", config.AgentListen)
+	}
+	host, port, err := net.SplitHostPort(config.AgentListen[i+3:])
+	if err != nil {
+		return "", fmt.Errorf("cannot derive a connect string from WT_AGENTLISTEN=%s, set WT_AGENTADVERTISE", config.AgentListen)
+	}
+	if host == "*" || host == "0.0.0.0" || host == "" {
+		if host, err = os.Hostname(); err != nil {
+			return "", err
+		}
+	}
+	return config.AgentListen[:i+3] + net.JoinHostPort(host, port), nil
+}
+
+//localAppIDs returns the users of this host that the agent can serve, those other than root
+//with a ~/bin/start script.
+func localAppIDs() ([]string, error) {
+	names, err := localUsers()
+	if err != nil {
+		return nil, err
+	}
+	appids := []string{}
+	for _, name := range names {
+		u, err := user.Lookup(name)
+		if err != nil || u.Uid == "0" {
+			continue
+		}
+		if appHasScript(u, "bin/start") {
+			appids = append(appids, name)
+		}
+	}
+	sort.Strings(appids)
+	return appids, nil
+}
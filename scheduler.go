@@ -2,90 +2,249 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	zmq "github.com/pebbe/zmq4"
 	"log"
 	"os"
 	"os/signal"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
-var schedulerDbMutex sync.Mutex
+//SchedulerDB holds the AppRecords of the scheduler, it is opened by SchedulerService.
+var SchedulerDB SchedulerStore
 
-//SchedulerDB maps AppID to Agent connect string
-var SchedulerDB map[string]string
+//schedOps maps the scheduler requests that need authorization to the operation checked by Authorize.
+var schedOps = map[int]string{
+	SchedLookup:    OpLookup,
+	SchedSet:       OpSet,
+	SchedUnset:     OpUnset,
+	SchedRegister:  OpRegister,
+	SchedHeartbeat: OpRegister,
+}
 
-//SchedLookup, SchedReply, SchedSet, SchedOk, SchedError, SchedUnknown, SchedNotFound, SchedPing
-//SchedPingReply are constants used in request specific actions from the scheduler by the CLI
-//in 0MQ messages.
-const (
-	SchedLookup = iota
-	SchedReply
-	SchedSet
-	SchedOk
-	SchedError
-	SchedUnknown
-	SchedNotFound
-	SchedPing
-	SchedPingReply
+//schedulerDBState is the state of the SchedulerDB reported by schedulerDBStatus, guarded by
+//schedulerDBMutex. schedulerReloadMutex serializes reloads on SIGHUP and by WatchSchedulerDB.
+var (
+	schedulerDBMutex     sync.Mutex
+	schedulerDBState     SchedulerDBStatus
+	schedulerReloadMutex sync.Mutex
 )
 
-//SchedulerMsg is a struct that represents requests and responses between the scheduler and CLI.
-//They are sent JSON encoded as 0MQ messages.
-type SchedulerMsg struct {
-	MsgType int
-	AppID   string
-	Address string
-	Error   string
+//OpenSchedulerDB opens the WT_SCHEDULERSTORE store at WT_SCHEDULERDBPATH as the SchedulerDB.
+func OpenSchedulerDB() error {
+	if config.Debug {
+		log.Println("OpenSchedulerDB(", config.SchedulerStore, ",", config.SchedulerDbPath, ")")
+	}
+	store, err := OpenSchedulerStore(config.SchedulerStore, config.SchedulerDbPath)
+	if err != nil {
+		return err
+	}
+	SchedulerDB = store
+	schedulerDBMutex.Lock()
+	schedulerDBState = SchedulerDBStatus{Loaded: time.Now()}
+	schedulerDBMutex.Unlock()
+	return nil
 }
 
-func init() {
-	SchedulerDB = make(map[string]string)
+//ReloadSchedulerDB reloads the SchedulerDB, records the outcome for schedulerDBStatus and Metrics
+//and logs the AppIDs the reload added, removed and changed. If the reload fails the records loaded
+//before stay in service.
+func ReloadSchedulerDB() error {
+	schedulerReloadMutex.Lock()
+	defer schedulerReloadMutex.Unlock()
+
+	before, _ := SchedulerDB.All()
+	err := SchedulerDB.Reload()
+	Metrics.Reload("scheduler", err)
+	schedulerDBMutex.Lock()
+	if err != nil {
+		schedulerDBState.ReloadError, schedulerDBState.ReloadFailed = err.Error(), time.Now()
+	} else {
+		schedulerDBState = SchedulerDBStatus{Loaded: time.Now()}
+	}
+	schedulerDBMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if after, err := SchedulerDB.All(); err == nil {
+		logSchedulerDBDiff(before, after)
+	}
+	return nil
 }
 
-//LoadSchedulerDB will load the SchedulerDB map from the specified JSON file.
-func LoadSchedulerDB(path string) error {
-	if config.Debug {
-		log.Println("LoadSchedulerDB(", path, ")")
+//logSchedulerDBDiff logs the AppIDs added (+), removed (-) and changed (~) between the records
+//before and after a reload, one per line.
+func logSchedulerDBDiff(before, after map[string]AppRecord) {
+	describe := func(rec AppRecord) string {
+		desc := strings.Join(rec.Agents, ",")
+		if len(rec.Tags) > 0 {
+			desc += " tags=" + strings.Join(rec.Tags, ",")
+		}
+		return desc
+	}
+	var lines []string
+	for appid, rec := range after {
+		old, ok := before[appid]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("+ %s %s", appid, describe(rec)))
+		case !reflect.DeepEqual(old, rec):
+			lines = append(lines, fmt.Sprintf("~ %s %s -> %s", appid, describe(old), describe(rec)))
+		}
+	}
+	for appid, rec := range before {
+		if _, ok := after[appid]; !ok {
+			lines = append(lines, fmt.Sprintf("- %s %s", appid, describe(rec)))
+		}
+	}
+	if len(lines) == 0 {
+		if config.Debug {
+			log.Println("SchedulerDB reloaded, no changes")
+		}
+		return
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][2:] < lines[j][2:] })
+	log.Printf("SchedulerDB reloaded, %d AppIDs changed:\n", len(lines))
+	for _, line := range lines {
+		log.Println("  " + line)
 	}
-	db, openErr := os.Open(path)
-	if openErr != nil {
-		return openErr
+}
+
+//schedulerDBStatus returns the state of the SchedulerDB for the ping reply.
+func schedulerDBStatus() *SchedulerDBStatus {
+	schedulerDBMutex.Lock()
+	status := schedulerDBState
+	schedulerDBMutex.Unlock()
+	if all, err := SchedulerDB.All(); err == nil {
+		status.Apps = len(all)
 	}
-	defer db.Close()
+	return &status
+}
 
-	info, statErr := db.Stat()
-	if statErr != nil {
-		return statErr
+//SchedulerLookup returns the agents for appid and their Status, in order of preference. The
+//SchedulerDB takes precedence over agents that registered themselves.
+func SchedulerLookup(appid string) ([]AgentState, bool) {
+	rec, ok, err := SchedulerDB.Get(appid)
+	if err != nil {
+		log.Println("SchedulerLookup(", appid, "):", err)
+	}
+	if ok && len(rec.Agents) > 0 {
+		agents := make([]AgentState, len(rec.Agents))
+		for i, address := range rec.Agents {
+			agents[i] = AgentState{Address: address, Status: RegistryStatus(address)}
+		}
+		return agents, true
+	}
+	agents := RegistryLookup(appid)
+	return agents, len(agents) > 0
+}
+
+//SchedulerList returns every AppID matching the glob pattern and its agent, and every known
+//agent. An empty pattern matches every AppID, a non-empty agent selects the apps on and the info
+//of that agent only. Apps for which allowed returns false are left out.
+func SchedulerList(pattern string, agent string, allowed func(string) bool) ([]SchedEntry, []AgentInfo, error) {
+	if pattern == "" {
+		pattern = "*"
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, nil, err
+	}
+
+	records, err := SchedulerDB.All()
+	if err != nil {
+		return nil, nil, err
+	}
+	appids := make(map[string]bool)
+	for appid := range records {
+		appids[appid] = true
+	}
+	agents := RegistryAgents()
+	for _, info := range agents {
+		for _, appid := range info.AppIDs {
+			appids[appid] = true
+		}
 	}
 
-	var in = make([]byte, info.Size())
+	apps := []SchedEntry{}
+	for appid := range appids {
+		if ok, _ := path.Match(pattern, appid); !ok || !allowed(appid) {
+			continue
+		}
+		states, _ := SchedulerLookup(appid)
+		if agent != "" && !hasAgent(states, agent) {
+			continue
+		}
+		rec := records[appid]
+		entry := SchedEntry{AppID: appid, Agents: states, Owner: rec.Owner, Created: rec.Created, Tags: rec.Tags}
+		if preferred, ok := PreferredAgent(states); ok {
+			entry.Address, entry.Status = preferred.Address, preferred.Status
+		} else if len(states) > 0 {
+			entry.Address, entry.Status = states[0].Address, states[0].Status
+		}
+		apps = append(apps, entry)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].AppID < apps[j].AppID })
 
-	_, readErr := db.Read(in)
-	if readErr != nil {
-		return readErr
+	visible := []AgentInfo{}
+	for _, info := range agents {
+		if agent != "" && info.Address != agent {
+			continue
+		}
+		var mine []string
+		for _, appid := range info.AppIDs {
+			if allowed(appid) {
+				mine = append(mine, appid)
+			}
+		}
+		info.AppIDs = mine
+		visible = append(visible, info)
 	}
-	if config.Debug == true && config.DebugLvl > 3 {
-		log.Print(in)
+	return apps, visible, nil
+}
+
+func hasAgent(agents []AgentState, address string) bool {
+	for _, a := range agents {
+		if a.Address == address {
+			return true
+		}
 	}
+	return false
+}
 
-	// NB: maps in Go are not safe to manipulate concurrently.
-	schedulerDbMutex.Lock()
-	defer schedulerDbMutex.Unlock()
-	marshalErr := json.Unmarshal(in, &SchedulerDB)
-	return marshalErr
+//SchedulerSet maps appid to the agent connect strings in the SchedulerDB, the first is the primary.
+//A new AppRecord is owned by owner, the tags of an existing one are only replaced if tags is not nil.
+func SchedulerSet(appid string, agents []string, owner string, tags []string) error {
+	if appid == "" || len(agents) == 0 {
+		return errors.New("AppID and agent address are required")
+	}
+	if err := validateAppRecord(appid, AppRecord{Agents: agents}); err != nil {
+		return err
+	}
+	rec, ok, err := SchedulerDB.Get(appid)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		rec = AppRecord{Owner: owner, Created: time.Now().UTC()}
+	}
+	rec.Agents = agents
+	if tags != nil {
+		rec.Tags = tags
+	}
+	return SchedulerDB.Put(appid, rec)
 }
 
-//SchedulerLookup is a wrapper around the SchedulerDB map to synchronize access
-func SchedulerLookup(appid string) (string, bool) {
-	schedulerDbMutex.Lock()
-	defer schedulerDbMutex.Unlock()
-	agent, ok := SchedulerDB[appid]
-	return agent, ok
+//SchedulerUnset removes appid from the SchedulerDB. Returns false if appid was not present.
+func SchedulerUnset(appid string) (bool, error) {
+	return SchedulerDB.Delete(appid)
 }
 
 //SchedulerSigHUPHandler causes the SchedulerDB to be reloaded on receipt of SIGHUP. Should be run as a separate go routine.
@@ -95,20 +254,42 @@ func SchedulerSigHUPHandler() {
 	for {
 		<-c //block until we receive SIGHUP
 		log.Println("Reloading SchedulerDB SIGHUP received.")
-		LoadSchedulerDB(config.SchedulerDbPath)
+		if SchedulerDB == nil {
+			continue
+		}
+		if _, ok := SchedulerDB.(*boltStore); ok {
+			continue //Only the scheduler has it open, there is nothing to reload.
+		}
+		if err := ReloadSchedulerDB(); err != nil {
+			log.Println("SchedulerDB.Reload, keeping the previous SchedulerDB: ", err)
+		}
 	}
 }
 
 //SchedulerService provides all the network based services of the Scheduler. It creates
 //the 0MQ listener, and responds to queries. It is intended to be run inside a go routine, it
-//does not return to its caller.
+//returns once services are stopping.
 func SchedulerService() {
 	if config.Debug {
 		log.Println("SchedulerService()")
 	}
 
-	if err := LoadSchedulerDB(config.SchedulerDbPath); err != nil {
-		log.Fatalln("LoadSchedulerDB: ", err)
+	if err := OpenSchedulerDB(); err != nil {
+		log.Fatalln("OpenSchedulerDB: ", err)
+	}
+	defer SchedulerDB.Close()
+	pinger, err := newClient(nil)
+	if err != nil {
+		log.Fatalln("SchedulerService() client:", err)
+	}
+	reaperDone := make(chan bool)
+	go func() {
+		RegistryReaper(pinger)
+		close(reaperDone)
+	}()
+	defer func() { <-reaperDone }() //Before the SchedulerDB is closed.
+	if store, ok := SchedulerDB.(*jsonStore); ok && config.SchedulerWatch {
+		go WatchSchedulerDB(store)
 	}
 
 	responder, err := zmq.NewSocket(zmq.REP)
@@ -116,17 +297,24 @@ func SchedulerService() {
 		log.Fatalln("SchedulerService() 0MQ NewSocket:", err.Error())
 	}
 	defer responder.Close()
+	//Give the last reply a moment to reach its client when the socket is closed.
+	responder.SetLinger(time.Second)
 
+	if err := curveServer(responder); err != nil {
+		log.Fatalln("SchedulerService() CURVE:", err)
+	}
 	if err := responder.Bind(config.SchedulerListen); err != nil {
 		log.Fatalln("SchedulerService():responder.Bind(", config.SchedulerListen, ")", err.Error())
 	}
 
-	for {
-		msg, err := responder.RecvBytes(0) //Flags for Recv?
-		if config.Debug {
-			log.Println("SchedulerService() 0MQ Recv:", bytes.NewBuffer(msg).String())
+	poller := zmq.NewPoller()
+	poller.Add(responder, zmq.POLLIN)
+	for services.stopping.Err() == nil {
+		polled, err := poller.Poll(shutdownPoll)
+		if err != nil || len(polled) == 0 {
+			continue
 		}
-
+		msg, metadata, err := responder.RecvBytesWithMetadata(0, auditMetadata...)
 		if config.Debug && err != nil {
 			log.Println("SchedulerService() 0MQ Recv error: ", err.Error())
 		}
@@ -134,174 +322,103 @@ func SchedulerService() {
 		if err != nil {
 			continue
 		}
+		caller, received := newAuditCaller(metadata), time.Now()
 		var Query SchedulerMsg
 		var Reply SchedulerMsg
 		if err := json.Unmarshal(msg, &Query); err != nil {
-			Reply = SchedulerMsg{SchedError, "", "", err.Error()}
+			Reply = SchedulerMsg{MsgType: SchedError, Error: err.Error(), Proto: ProtocolVersion}
+			AuditMalformed("scheduler", caller, err, received)
 			b, _ := json.Marshal(Reply)
 			responder.SendBytes(b, 0)
 			continue
 		}
+		if config.Debug {
+			log.Println("SchedulerService() 0MQ Recv:", Query)
+		}
+
+		if op, ok := schedOps[Query.MsgType]; ok {
+			if err := Authorize(Query.User, Query.Password, op, Query.AppID); err != nil {
+				Reply = SchedulerMsg{MsgType: SchedDenied, AppID: Query.AppID, Error: err.Error(), Proto: ProtocolVersion}
+				AuditScheduler(caller, &Query, &Reply, received)
+				b, _ := json.Marshal(Reply)
+				responder.SendBytes(b, 0)
+				continue
+			}
+		}
+
 		switch {
 		case Query.MsgType == SchedLookup:
-			agent, ok := SchedulerLookup(Query.AppID)
+			agents, ok := SchedulerLookup(Query.AppID)
+			Metrics.Lookup(ok)
 			if ok == true {
-				Reply = SchedulerMsg{SchedReply, Query.AppID, agent, ""}
+				preferred, alive := PreferredAgent(agents)
+				if !alive {
+					preferred = agents[0]
+				}
+				Reply = SchedulerMsg{MsgType: SchedReply, AppID: Query.AppID, Address: preferred.Address, Status: preferred.Status,
+					AppAgents: agents}
+			} else {
+				Reply = SchedulerMsg{MsgType: SchedNotFound, AppID: Query.AppID}
+			}
+		case Query.MsgType == SchedSet:
+			agents := []string{Query.Address} //Clients before AppAgents send a single agent.
+			if len(Query.AppAgents) > 0 {
+				agents = nil
+				for _, a := range Query.AppAgents {
+					agents = append(agents, a.Address)
+				}
+			}
+			if err := SchedulerSet(Query.AppID, agents, Query.User, Query.Tags); err != nil {
+				Reply = SchedulerMsg{MsgType: SchedError, AppID: Query.AppID, Error: err.Error()}
+			} else {
+				Reply = SchedulerMsg{MsgType: SchedOk, AppID: Query.AppID, Address: Query.Address}
+			}
+		case Query.MsgType == SchedUnset:
+			found, err := SchedulerUnset(Query.AppID)
+			switch {
+			case err != nil:
+				Reply = SchedulerMsg{MsgType: SchedError, AppID: Query.AppID, Error: err.Error()}
+			case !found:
+				Reply = SchedulerMsg{MsgType: SchedNotFound, AppID: Query.AppID}
+			default:
+				Reply = SchedulerMsg{MsgType: SchedOk, AppID: Query.AppID}
+			}
+		case Query.MsgType == SchedRegister:
+			if Query.Address == "" {
+				Reply = SchedulerMsg{MsgType: SchedError, Error: "agent address is required"}
+				break
+			}
+			RegistryRegister(AgentInfo{Address: Query.Address, Hostname: Query.Hostname, Version: Query.Version, AppIDs: Query.AppIDs})
+			Reply = SchedulerMsg{MsgType: SchedOk, Address: Query.Address}
+		case Query.MsgType == SchedHeartbeat:
+			if RegistryHeartbeat(Query.Address) {
+				Reply = SchedulerMsg{MsgType: SchedOk, Address: Query.Address}
 			} else {
-				Reply = SchedulerMsg{SchedNotFound, Query.AppID, "", ""}
+				Reply = SchedulerMsg{MsgType: SchedNotFound, Address: Query.Address}
+			}
+		case Query.MsgType == SchedList:
+			ent, err := Authenticate(Query.User, Query.Password, OpLookup)
+			if err != nil {
+				Reply = SchedulerMsg{MsgType: SchedDenied, Error: err.Error()}
+				break
+			}
+			apps, agents, err := SchedulerList(Query.AppID, Query.Address, ent.AllowsApp)
+			if err != nil {
+				Reply = SchedulerMsg{MsgType: SchedError, Error: err.Error()}
+			} else {
+				Reply = SchedulerMsg{MsgType: SchedReply, Apps: apps, Agents: agents}
 			}
 		case Query.MsgType == SchedPing:
-			Reply = SchedulerMsg{SchedPingReply, "", "", ""}
+			Reply = SchedulerMsg{MsgType: SchedPingReply, Caps: schedCaps, DB: schedulerDBStatus()}
 		default:
-			Reply = SchedulerMsg{SchedUnknown, "", "", ""}
+			Reply = SchedulerMsg{MsgType: SchedUnknown, Error: fmt.Sprintf("unsupported request type %d", Query.MsgType)}
 		}
 
+		Reply.Proto = ProtocolVersion
+		AuditScheduler(caller, &Query, &Reply, received)
 		b, _ := json.Marshal(Reply)
 		responder.SendBytes(b, 0)
 
 	} //end for{}
-}
-
-//SchedulerReqLookup sends a LOOKUP request to the scheduler defined in WT_SCHED env variable.
-//Returns the agent string on success, and "" with an error on failure. Uses a 1 second timeout.
-func SchedulerReqLookup(appid string) (string, error) {
-	if config.Debug {
-		log.Printf("SchedulerReqLookup(%s) to %s\n", appid, config.SchedulerAddress)
-	}
-	requester, err := zmq.NewSocket(zmq.REQ)
-	if err != nil {
-		return "", err
-	}
-	if config.Debug {
-		log.Println("SchedulerReqLookup() 0MQ NewSocket(zmq.REQ) ok")
-	}
-	defer requester.Close()
-
-	connErr := requester.Connect(config.SchedulerAddress)
-	if connErr != nil {
-		return "", connErr
-	}
-
-	poller := zmq.NewPoller()
-	poller.Add(requester, zmq.POLLIN)
-	var msg SchedulerMsg
-	msg = SchedulerMsg{SchedLookup, appid, "", ""}
-	jsonOut, jsonErr := json.Marshal(msg)
-	if jsonErr != nil {
-		return "", jsonErr
-	}
-
-	byteSent, sendErr := requester.SendBytes(jsonOut, 0)
-	if sendErr != nil {
-		log.Println("SchedulerReqLookup() 0MQ SendBytes:", sendErr)
-		return "", sendErr
-	}
-	if config.Debug {
-		log.Println("SchedulerReqLookup() 0MQ SendBytes sent ", byteSent)
-	}
-	//Poll socket for a reply, with a timeout
-	sockets, pollerErr := poller.Poll(1000 * time.Millisecond)
-	if pollerErr != nil {
-		return "", pollerErr // Interrupted by a syscall?
-	}
-
-	// Process the server reply. If we didn't get a reply close the socket and fail.
-	if len(sockets) > 0 { //We got something
-		reply, zmqErr := requester.RecvBytes(0)
-		if zmqErr != nil {
-			return "", zmqErr
-		}
-		if config.Debug {
-			log.Println("SchedulerReqLookup() 0MQ Recv msg:", bytes.NewBuffer(reply).String())
-		}
-
-		jsonErr = json.Unmarshal(reply, &msg)
-		if jsonErr != nil {
-			return "", jsonErr
-		}
-
-		switch {
-
-		case msg.MsgType == SchedReply:
-			return msg.Address, nil
-		case msg.MsgType == SchedNotFound:
-			return "", errors.New("AppID not found")
-		default:
-			return "", errors.New(msg.Error)
-		}
-
-	} else {
-		return "", errors.New("timeout")
-	}
-
-}
-
-//SchedulerPing sends a PING request to the scheduler defined in WT_SCHED env variable. Returns true
-//on success, and false with an error on failure. Uses a 1 second timeout.
-func SchedulerPing() (bool, error) {
-	if config.Debug {
-		log.Println("SchedulerPing() to ", config.SchedulerAddress)
-	}
-
-	requester, err := zmq.NewSocket(zmq.REQ)
-	if err != nil {
-		return false, err
-	}
-	if config.Debug {
-		log.Println("SchedulerPing() 0MQ NewSocket(zmq.REQ) ok")
-	}
-	defer requester.Close()
-
-	connErr := requester.Connect(config.SchedulerAddress)
-	if connErr != nil {
-		return false, connErr
-	}
-
-	poller := zmq.NewPoller()
-	poller.Add(requester, zmq.POLLIN)
-
-	var msg SchedulerMsg
-	msg = SchedulerMsg{SchedPing, "", "", ""}
-	jsonOut, jsonErr := json.Marshal(msg)
-	if jsonErr != nil {
-		return false, jsonErr
-	}
-
-	byteSent, sendErr := requester.SendBytes(jsonOut, 0)
-	if sendErr != nil {
-		log.Fatalln("SchedulerPing() 0MQ SendBytes:", sendErr.Error())
-	}
-	if config.Debug {
-		log.Println("SchedulerPing() 0MQ SendBytes sent ", byteSent)
-	}
-
-	//Poll socket for a reply, with a timeout
-	sockets, pollerErr := poller.Poll(1000 * time.Millisecond)
-	if pollerErr != nil {
-		return false, pollerErr // Interrupted by a syscall?
-	}
-
-	// Process the server reply. If we didn't get a reply close the socket and fail.
-	if len(sockets) > 0 {
-		reply, zmqErr := requester.RecvBytes(0)
-		if zmqErr != nil {
-			return false, zmqErr
-		}
-		if config.Debug {
-			log.Println("SchedulerPing() 0MQ Recv msg:", bytes.NewBuffer(reply).String())
-		}
-
-		jsonErr = json.Unmarshal(reply, &msg)
-		if jsonErr != nil {
-			return false, jsonErr
-		}
-
-		if msg.MsgType == SchedPingReply {
-			return true, nil
-		}
-		return false, errors.New(msg.Error)
-
-	}
-	return false, errors.New("timeout")
-
+	log.Println("SchedulerService(): shutting down")
 }
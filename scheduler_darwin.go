@@ -0,0 +1,11 @@
+package main
+
+import (
+	"log"
+)
+
+//WatchSchedulerDB is only supported on Linux, on Darwin the SchedulerDB is reloaded on SIGHUP
+//only.
+func WatchSchedulerDB(store *jsonStore) {
+	log.Println("WT_SCHEDULERWATCH is only supported on Linux, send SIGHUP after editing", store.path)
+}
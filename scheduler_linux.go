@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+)
+
+//schedulerWatchDebounce is how long the SchedulerDB file must stay unchanged before
+//WatchSchedulerDB reloads it, so an editor saving in several steps causes a single reload.
+const schedulerWatchDebounce = 500 * time.Millisecond
+
+//schedulerWatchEvents are the inotify events on the directory of the SchedulerDB that may change
+//it. Editors and writeFileAtomic replace the file by renaming another over it, so the directory
+//is watched rather than the file. Removing the file is not a change, the SchedulerDB is kept
+//until a new file is written.
+const schedulerWatchEvents = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO
+
+//WatchSchedulerDB reloads the SchedulerDB with ReloadSchedulerDB when the file of store changes,
+//once it has been left alone for schedulerWatchDebounce. Writes by the store itself, on
+//"webtools scheduler set" and "unset", are not reloaded. Should be run as a separate go routine,
+//it returns when services are stopping.
+func WatchSchedulerDB(store *jsonStore) {
+	path := store.path
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		log.Println("WatchSchedulerDB() inotify:", err)
+		return
+	}
+	defer unix.Close(fd)
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(path), schedulerWatchEvents); err != nil {
+		log.Println("WatchSchedulerDB() inotify watch", filepath.Dir(path), ":", err)
+		return
+	}
+	log.Println("Watching", path, "for changes")
+
+	name := filepath.Base(path)
+	buf := make([]byte, 64*1024)
+	var changed time.Time //Of the last change not reloaded yet
+	for services.stopping.Err() == nil {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(shutdownPoll/time.Millisecond))
+		if err != nil && err != unix.EINTR {
+			log.Println("WatchSchedulerDB() poll:", err)
+			return
+		}
+		if n > 0 {
+			touched, gone := inotifyEvents(fd, buf, name)
+			if gone {
+				log.Println("WatchSchedulerDB():", filepath.Dir(path), "was removed, no longer watching", path)
+				return
+			}
+			if touched {
+				changed = time.Now()
+			}
+		}
+		if !changed.IsZero() && time.Since(changed) >= schedulerWatchDebounce {
+			changed = time.Time{}
+			modified, err := store.Changed()
+			switch {
+			case os.IsNotExist(err):
+				log.Println("WatchSchedulerDB():", path, "is missing, keeping the SchedulerDB until it is written again")
+				continue
+			case err == nil && !modified:
+				if config.Debug {
+					log.Println("WatchSchedulerDB():", path, "was written by the scheduler, not reloading")
+				}
+				continue
+			}
+			log.Println("Reloading SchedulerDB", path, "changed.")
+			if err := ReloadSchedulerDB(); err != nil {
+				log.Println("SchedulerDB.Reload, keeping the previous SchedulerDB: ", err)
+			}
+		}
+	}
+}
+
+//inotifyEvents reads the pending events of the inotify instance fd into buf. touched reports
+//whether one was for the file name or events were lost, gone whether the watched directory went
+//away.
+func inotifyEvents(fd int, buf []byte, name string) (touched bool, gone bool) {
+	for {
+		n, err := unix.Read(fd, buf)
+		if err != nil || n <= 0 {
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + unix.SizeofInotifyEvent
+			offset = start + int(event.Len)
+			switch {
+			case event.Mask&unix.IN_Q_OVERFLOW != 0:
+				touched = true
+			case event.Mask&unix.IN_IGNORED != 0:
+				gone = true
+			case event.Len > 0 && string(bytes.TrimRight(buf[start:offset], "\x00")) == name:
+				touched = true
+			}
+		}
+	}
+}
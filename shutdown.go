@@ -0,0 +1,90 @@
+//
+package main
+
+import (
+	"context"
+	zmq "github.com/pebbe/zmq4"
+	"log"
+	"sync"
+	"time"
+)
+
+//shutdownPoll is how often services blocked waiting for requests check whether shutdown began.
+const shutdownPoll = 250 * time.Millisecond
+
+//shutdownKillWait is how long Shutdown waits for services to stop once running commands were
+//killed at the end of the grace period.
+const shutdownKillWait = 10 * time.Second
+
+//serviceGroup tracks the services run by webtools service so they can be shut down gracefully.
+//Once stopping is done the services stop accepting requests and return when the requests they
+//are running have been answered. Once killing is done, at the end of the grace period, running
+//commands are killed, and the services report the work they cut off with CutOff.
+type serviceGroup struct {
+	wg       sync.WaitGroup
+	stopping context.Context
+	killing  context.Context
+	stop     context.CancelFunc
+	kill     context.CancelFunc
+	mu       sync.Mutex
+	cutOff   []string
+}
+
+//services are the services running in this process.
+var services = newServiceGroup()
+
+func newServiceGroup() *serviceGroup {
+	g := &serviceGroup{}
+	g.stopping, g.stop = context.WithCancel(context.Background())
+	g.killing, g.kill = context.WithCancel(context.Background())
+	return g
+}
+
+//Go runs the service fn on a new go routine. fn must return once stopping is done and its
+//requests are answered.
+func (g *serviceGroup) Go(fn func()) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		fn()
+	}()
+}
+
+//CutOff records that a service ended work such as running commands early during shutdown.
+func (g *serviceGroup) CutOff(what string) {
+	g.mu.Lock()
+	g.cutOff = append(g.cutOff, what)
+	g.mu.Unlock()
+}
+
+//Shutdown stops the services, giving them grace to finish the requests they are running before
+//those are killed, then terminates 0MQ. It returns false if work was cut off or the services did
+//not stop.
+func (g *serviceGroup) Shutdown(grace time.Duration) bool {
+	g.stop()
+	killTimer := time.AfterFunc(grace, g.kill)
+	defer killTimer.Stop()
+
+	done := make(chan bool)
+	go func() {
+		g.wg.Wait()
+		StopCurveAuth()
+		if err := zmq.Term(); err != nil {
+			log.Println("Shutdown() zmq.Term:", err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace + shutdownKillWait):
+		log.Println("Shutdown(): services did not stop", shutdownKillWait, "after the grace period, exiting anyway")
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, what := range g.cutOff {
+		log.Println("Shutdown(): cut off", what)
+	}
+	return len(g.cutOff) == 0
+}
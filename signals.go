@@ -0,0 +1,52 @@
+//
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//signalNames maps the signal names accepted by "webtools kill" to signals. Signals are sent
+//between CLI and agent by name, since the numbers differ between platforms.
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"ABRT": syscall.SIGABRT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"ALRM": syscall.SIGALRM,
+	"TERM": syscall.SIGTERM,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+	"TSTP": syscall.SIGTSTP,
+}
+
+//ParseSignal accepts a signal name with or without the SIG prefix, or a signal number, and
+//returns the canonical name, e.g. "9", "SIGKILL" and "kill" all return "KILL".
+func ParseSignal(s string) (string, error) {
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if _, ok := signalNames[name]; ok {
+		return name, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		for name, sig := range signalNames {
+			if int(sig) == n {
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unknown signal %q", s)
+}
+
+//lookupSignal returns the local signal for a canonical signal name.
+func lookupSignal(name string) (syscall.Signal, error) {
+	sig, ok := signalNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
@@ -0,0 +1,387 @@
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//AppRecord is what the scheduler stores for an AppID. Agents are the connect strings of the agents
+//running the app, the first is the primary and the others its secondaries in order of preference.
+//Owner is the user that created the record.
+type AppRecord struct {
+	Agents  []string
+	Owner   string `json:",omitempty"`
+	Created time.Time
+	Tags    []string `json:",omitempty"`
+}
+
+//decodeAppRecord decodes a JSON AppRecord. Records written before AppRecord are a plain agent
+//connect string, and records written before Agents have a single Agent.
+func decodeAppRecord(value []byte) (AppRecord, error) {
+	var rec AppRecord
+	if len(value) > 0 && value[0] == '"' {
+		var agent string
+		err := json.Unmarshal(value, &agent)
+		rec.Agents = []string{agent}
+		return rec, err
+	}
+	var old struct {
+		AppRecord
+		Agent string
+	}
+	if err := json.Unmarshal(value, &old); err != nil {
+		return rec, err
+	}
+	rec = old.AppRecord
+	if len(rec.Agents) == 0 && old.Agent != "" {
+		rec.Agents = []string{old.Agent}
+	}
+	return rec, nil
+}
+
+//SchedulerStore holds the AppRecords of the scheduler. Implementations are safe for concurrent use.
+type SchedulerStore interface {
+	//Get returns the record for appid, false if there is none.
+	Get(appid string) (AppRecord, bool, error)
+	//Put creates or replaces the record for appid.
+	Put(appid string, rec AppRecord) error
+	//Delete removes the record for appid, false if there was none.
+	Delete(appid string) (bool, error)
+	//All returns a copy of every record.
+	All() (map[string]AppRecord, error)
+	//Reload picks up changes made to the store by other programs, where that is needed.
+	Reload() error
+	Close() error
+}
+
+//StoreJSON and StoreBolt are the values of WT_SCHEDULERSTORE.
+const (
+	StoreJSON = "json"
+	StoreBolt = "bolt"
+)
+
+//OpenSchedulerStore opens the SchedulerStore of type kind at path.
+func OpenSchedulerStore(kind string, path string) (SchedulerStore, error) {
+	switch kind {
+	case StoreJSON, "":
+		return openJSONStore(path)
+	case StoreBolt:
+		return openBoltStore(path)
+	}
+	return nil, fmt.Errorf("unknown scheduler store %q, use %s or %s", kind, StoreJSON, StoreBolt)
+}
+
+//ImportSchedulerDB copies the records of the JSON scheduler DB at path, in the current or the
+//pre AppRecord map of AppID to agent format, into store. Owner and Created of records already in
+//store are kept, new records without a Created are created at the time of the import. Returns the
+//number of records imported.
+func ImportSchedulerDB(store SchedulerStore, path string) (int, error) {
+	in, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	db, err := decodeSchedulerDB(in)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", path, err)
+	}
+	now := time.Now().UTC()
+	for appid, rec := range db {
+		if old, ok, err := store.Get(appid); err != nil {
+			return 0, err
+		} else if ok {
+			rec.Owner, rec.Created = old.Owner, old.Created
+		} else if rec.Created.IsZero() {
+			rec.Created = now
+		}
+		if err := store.Put(appid, rec); err != nil {
+			return 0, err
+		}
+	}
+	return len(db), nil
+}
+
+//decodeSchedulerDB decodes a JSON scheduler DB, see decodeAppRecord for the formats of its values.
+//Every record is checked with validateAppRecord.
+func decodeSchedulerDB(in []byte) (map[string]AppRecord, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(in, &raw); err != nil {
+		return nil, err
+	}
+	db := make(map[string]AppRecord, len(raw))
+	for appid, value := range raw {
+		rec, err := decodeAppRecord(value)
+		if err == nil {
+			err = validateAppRecord(appid, rec)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("AppID %q: %s", appid, err)
+		}
+		db[appid] = rec
+	}
+	return db, nil
+}
+
+//appIDPattern matches valid AppIDs. AppIDs are Unix user names on the agents.
+var appIDPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,31}$`)
+
+//validateAppRecord checks that appid is a valid AppID and that rec has agents, each of them a
+//well-formed 0MQ connect string.
+func validateAppRecord(appid string, rec AppRecord) error {
+	if !appIDPattern.MatchString(appid) {
+		return errors.New("invalid AppID, use up to 32 letters, digits, _, . and -")
+	}
+	if len(rec.Agents) == 0 {
+		return errors.New("no agents")
+	}
+	for _, agent := range rec.Agents {
+		if err := validateEndpoint(agent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//validateEndpoint checks that endpoint is a 0MQ connect string an agent can be reached at:
+//tcp://<host>:<port>, ipc://<path> or inproc://<name>.
+func validateEndpoint(endpoint string) error {
+	parts := strings.SplitN(endpoint, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("agent %q: not a 0MQ connect string, e.g. tcp://host:9924", endpoint)
+	}
+	switch parts[0] {
+	case "tcp":
+		host, port, err := net.SplitHostPort(parts[1])
+		if err != nil {
+			return fmt.Errorf("agent %q: %s", endpoint, err)
+		}
+		if host == "" || host == "*" {
+			return fmt.Errorf("agent %q: missing host", endpoint)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("agent %q: invalid port %q", endpoint, port)
+		}
+	case "ipc", "inproc":
+	default:
+		return fmt.Errorf("agent %q: unsupported transport %q, use tcp, ipc or inproc", endpoint, parts[0])
+	}
+	return nil
+}
+
+//jsonStore keeps the records in memory and writes every change atomically to a JSON file.
+type jsonStore struct {
+	mu   sync.Mutex
+	path string
+	db   map[string]AppRecord
+	data []byte //The file as last loaded or saved, nil if there was none.
+}
+
+func openJSONStore(path string) (*jsonStore, error) {
+	s := &jsonStore{path: path}
+	if err := s.load(true); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *jsonStore) Get(appid string) (AppRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.db[appid]
+	return rec, ok, nil
+}
+
+func (s *jsonStore) Put(appid string, rec AppRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.copy()
+	db[appid] = rec
+	return s.save(db)
+}
+
+func (s *jsonStore) Delete(appid string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.db[appid]; !ok {
+		return false, nil
+	}
+	db := s.copy()
+	delete(db, appid)
+	return true, s.save(db)
+}
+
+func (s *jsonStore) All() (map[string]AppRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.copy(), nil
+}
+
+//Reload reads the file again, the records in memory are only replaced if it decodes. A missing
+//file is an error, only openJSONStore starts with an empty store when there is no file yet.
+func (s *jsonStore) Reload() error {
+	return s.load(false)
+}
+
+//load reads the file into memory. If missingOK is set a missing file is an empty SchedulerDB.
+//s.mu is held from reading the file to replacing the records, so a Put or Delete cannot land in
+//between and be lost when records read before it replace it.
+func (s *jsonStore) load(missingOK bool) error {
+	if config.Debug {
+		log.Println("jsonStore.load(", s.path, missingOK, ")")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := make(map[string]AppRecord)
+	in, err := ioutil.ReadFile(s.path)
+	switch {
+	case err == nil:
+		if db, err = decodeSchedulerDB(in); err != nil {
+			return fmt.Errorf("%s: %s", s.path, err)
+		}
+	case !os.IsNotExist(err) || !missingOK:
+		return err
+	}
+	s.db, s.data = db, in
+	return nil
+}
+
+//Changed reports whether the file differs from what the store last loaded or saved, so changes
+//the store made itself can be told from edits. The error is that of reading the file.
+func (s *jsonStore) Changed() (bool, error) {
+	in, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !bytes.Equal(in, s.data), nil
+}
+
+func (s *jsonStore) Close() error {
+	return nil
+}
+
+//copy returns a copy of s.db. Caller must hold s.mu.
+func (s *jsonStore) copy() map[string]AppRecord {
+	db := make(map[string]AppRecord, len(s.db)+1)
+	for k, v := range s.db {
+		db[k] = v
+	}
+	return db
+}
+
+//save atomically replaces the file with db and then makes db current, so a failed write leaves
+//both unchanged. Caller must hold s.mu.
+func (s *jsonStore) save(db map[string]AppRecord) error {
+	if config.Debug {
+		log.Println("jsonStore.save(", s.path, ")")
+	}
+	out, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+	out = append(out, '\n')
+	if err := writeFileAtomic(s.path, out, 0644); err != nil {
+		return err
+	}
+	s.db, s.data = db, out
+	return nil
+}
+
+//appsBucket is the bolt bucket holding the JSON encoded AppRecords, keyed by AppID.
+var appsBucket = []byte("apps")
+
+//boltStore keeps the records in a bolt database, every change is its own transaction.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(appsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db}, nil
+}
+
+func (s *boltStore) Get(appid string) (AppRecord, bool, error) {
+	var rec AppRecord
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(appsBucket).Get([]byte(appid))
+		if v == nil {
+			return nil
+		}
+		ok = true
+		var err error
+		rec, err = decodeAppRecord(v)
+		return err
+	})
+	return rec, ok, err
+}
+
+func (s *boltStore) Put(appid string, rec AppRecord) error {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(appsBucket).Put([]byte(appid), v)
+	})
+}
+
+func (s *boltStore) Delete(appid string) (bool, error) {
+	var ok bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(appsBucket)
+		if ok = b.Get([]byte(appid)) != nil; !ok {
+			return nil
+		}
+		return b.Delete([]byte(appid))
+	})
+	return ok, err
+}
+
+func (s *boltStore) All() (map[string]AppRecord, error) {
+	db := make(map[string]AppRecord)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(appsBucket).ForEach(func(k, v []byte) error {
+			rec, err := decodeAppRecord(v)
+			if err != nil {
+				return fmt.Errorf("AppID %s: %s", k, err)
+			}
+			db[string(k)] = rec
+			return nil
+		})
+	})
+	return db, err
+}
+
+//Reload does nothing, bolt allows only one program to open the database.
+func (s *boltStore) Reload() error {
+	return nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateAppRecord(t *testing.T) {
+	tests := []struct {
+		appid  string
+		agents []string
+		ok     bool
+	}{
+		{"app", []string{"tcp://web1:9924"}, true},
+		{"my_app-2.0", []string{"tcp://web1:9924", "tcp://[::1]:9924"}, true},
+		{"app", []string{"ipc:///var/run/webtools.sock", "inproc://agent"}, true},
+		{strings.Repeat("a", 32), []string{"tcp://web1:9924"}, true},
+		{"", []string{"tcp://web1:9924"}, false},
+		{strings.Repeat("a", 33), []string{"tcp://web1:9924"}, false},
+		{"-app", []string{"tcp://web1:9924"}, false},
+		{"../etc", []string{"tcp://web1:9924"}, false},
+		{"app one", []string{"tcp://web1:9924"}, false},
+		{"app", nil, false},
+		{"app", []string{"web1:9924"}, false},
+		{"app", []string{"tcp://"}, false},
+		{"app", []string{"tcp://web1"}, false},
+		{"app", []string{"tcp://:9924"}, false},
+		{"app", []string{"tcp://*:9924"}, false},
+		{"app", []string{"tcp://web1:0"}, false},
+		{"app", []string{"tcp://web1:65536"}, false},
+		{"app", []string{"tcp://web1:http"}, false},
+		{"app", []string{"udp://web1:9924"}, false},
+		{"app", []string{"tcp://web1:9924", "web2"}, false},
+	}
+	for _, test := range tests {
+		err := validateAppRecord(test.appid, AppRecord{Agents: test.agents})
+		if (err == nil) != test.ok {
+			t.Errorf("validateAppRecord(%q, %q) = %v, want ok %v", test.appid, test.agents, err, test.ok)
+		}
+	}
+}
+
+//TestJSONStoreReload checks that a reload of a file that is missing or does not validate fails
+//and keeps the records loaded before.
+func TestJSONStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webtools-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "scheduler.json")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"app": "tcp://web1:9924"}`)
+	s, err := openJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{
+		`{"bad app": "tcp://web1:9924"}`,
+		`{"app": "web2:9924"}`,
+		`{"app": {"Agents": []}}`,
+		`{"app": `,
+		"",
+	} {
+		if content == "" {
+			os.Remove(path)
+		} else {
+			write(content)
+		}
+		if err := s.Reload(); err == nil {
+			t.Errorf("Reload of %q succeeded, want an error", content)
+		}
+		if rec, ok, _ := s.Get("app"); !ok || len(rec.Agents) != 1 || rec.Agents[0] != "tcp://web1:9924" {
+			t.Errorf("after Reload of %q app is %+v, %v, want the previous record", content, rec, ok)
+		}
+	}
+
+	write(`{"other": {"Agents": ["tcp://web2:9924"]}}`)
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := s.All(); len(all) != 1 || all["other"].Agents[0] != "tcp://web2:9924" {
+		t.Errorf("after Reload the records are %+v, want only other", all)
+	}
+}
+
+//TestJSONStorePutDuringReload checks that a Put racing a Reload is never lost: whichever runs
+//last, the file and the records in memory both have it.
+func TestJSONStorePutDuringReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webtools-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := openJSONStore(filepath.Join(dir, "scheduler.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Enough records that decoding a reload takes a while, for the Put to land during it.
+	seed := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		seed[fmt.Sprintf("seed%d", i)] = "tcp://web1:9924"
+	}
+	b, _ := json.Marshal(seed)
+	if err := ioutil.WriteFile(s.path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		appid := "app" + strings.Repeat("x", i%20)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := s.Put(appid, AppRecord{Agents: []string{"tcp://web1:9924"}}); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := s.Reload(); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+		if _, ok, _ := s.Get(appid); !ok {
+			t.Fatalf("Put of %s lost to a concurrent Reload", appid)
+		}
+		if _, err := s.Delete(appid); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//TestImportSchedulerDB checks that an import keeps Owner and Created of records already in the
+//store and creates the others at the time of the import.
+func TestImportSchedulerDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webtools-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := openJSONStore(filepath.Join(dir, "scheduler.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := s.Put("old", AppRecord{Agents: []string{"tcp://web1:9924"}, Owner: "dev", Created: created}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "import.json")
+	if err := ioutil.WriteFile(path, []byte(`{"old": "tcp://web2:9924", "new": "tcp://web2:9924"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	if n, err := ImportSchedulerDB(s, path); err != nil || n != 2 {
+		t.Fatalf("ImportSchedulerDB = %d, %v, want 2", n, err)
+	}
+	if rec, _, _ := s.Get("old"); rec.Agents[0] != "tcp://web2:9924" || rec.Owner != "dev" || !rec.Created.Equal(created) {
+		t.Errorf("old is %+v, want the imported agent with the previous Owner and Created", rec)
+	}
+	if rec, _, _ := s.Get("new"); rec.Created.Before(before) || rec.Created.After(time.Now()) {
+		t.Errorf("new was created at %v, want the time of the import", rec.Created)
+	}
+}